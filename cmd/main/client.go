@@ -2,16 +2,22 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
+	"crypto/tls"
 	_ "embed"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log"
 	"mime"
 	"net"
 	"net/http"
 	"net/url"
+	"path"
+	"strconv"
 	"strings"
 	"time"
 
@@ -26,14 +32,21 @@ var loginHtml string
 
 const oauthCookieName = "access-token"
 
+// header carrying the message of /webdir/stream, the body is the raw chunk
+const webDirMessageHeader = "X-Webdir-Message"
+
 type httpServer struct {
 	node           *node.NodeConfig
 	httpServer     net.Listener
 	clientPassword string
+	// nil if TLS is not configured
+	tlsConfig *tls.Config
+	// client used to talk to other nodes
+	httpClient *http.Client
 }
 
 func mustNewHttpServer(addr string) *httpServer {
-	srv := &httpServer{}
+	srv := &httpServer{httpClient: http.DefaultClient}
 	httpServer, err := net.Listen("tcp", addr)
 	if err != nil {
 		log.Fatalf("Failed to start listen on ")
@@ -47,23 +60,58 @@ func (srv *httpServer) listenAndServe() {
 
 	// THIS IS A SPECIAL ROUTE THAT IS ONLY USED BY NODES TO COMMUNICATE WITH EACH OTHER
 	mux.HandleFunc("/webdir", srv.webDirHandler)
+	mux.HandleFunc("/webdir/stream", srv.webDirStreamHandler)
 
 	mux.HandleFunc("/login", srv.loginHandler)
 	mux.HandleFunc("/", srv.homeHandler)
 
 	// ROUTES THAT NEEDS OAUTH
 	mux.HandleFunc("/record", srv.oauthFirst(srv.recordHandler, http.MethodGet))
-	mux.HandleFunc("/dir", srv.oauthFirst(srv.dirHandler, http.MethodGet))
+	mux.HandleFunc("/dir", srv.oauthFirst(srv.dirHandler, http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete))
 	mux.HandleFunc("/nodes", srv.oauthFirst(srv.nodesHandler, http.MethodGet))
+	mux.HandleFunc("/members", srv.oauthFirst(srv.membersHandler, http.MethodGet))
+	mux.HandleFunc("/sync", srv.oauthFirst(srv.syncHandler, http.MethodGet))
+	mux.HandleFunc("/outbox", srv.oauthFirst(srv.outboxHandler, http.MethodGet))
+	mux.HandleFunc("/routes", srv.oauthFirst(srv.routesHandler, http.MethodGet))
+	mux.HandleFunc("/conflicts", srv.oauthFirst(srv.conflictsHandler, http.MethodGet, http.MethodDelete))
 	mux.HandleFunc("/ping", srv.oauthFirst(srv.recordHandler, http.MethodGet))
 	mux.HandleFunc("/file", srv.oauthFirst(srv.fileHandler, http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete))
+	mux.HandleFunc("/versions", srv.oauthFirst(srv.versionsHandler, http.MethodGet, http.MethodPost))
+	mux.HandleFunc("/versions/diff", srv.oauthFirst(srv.versionsDiffHandler, http.MethodGet))
+	mux.HandleFunc("/stream", srv.oauthFirst(srv.streamHandler, http.MethodGet))
+	mux.HandleFunc("/upload", srv.oauthFirst(srv.uploadHandler, http.MethodGet, http.MethodPut))
 	mux.HandleFunc("/stop", srv.oauthFirst(srv.stopHandler, http.MethodGet))
+	mux.HandleFunc("/drain", srv.oauthFirst(srv.drainHandler, http.MethodPost))
 	// END OF ROUTES ThAT NEEDS OAUTH
 
+	if srv.tlsConfig != nil {
+		log.Printf("Node(%s) HTTPS listening on: %s", srv.node.Node.Oauth.UserName, srv.httpServer.Addr())
+		http.Serve(tls.NewListener(srv.httpServer, srv.tlsConfig), mux)
+		return
+	}
 	log.Printf("Node(%s) HTTP listening on: %s", srv.node.Node.Oauth.UserName, srv.httpServer.Addr())
 	http.Serve(srv.httpServer, mux)
 }
 
+// setTLSConfig configures both the server and the client used to talk to other nodes
+func (srv *httpServer) setTLSConfig(config *tls.Config) {
+	srv.tlsConfig = config
+	if config == nil {
+		return
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialTLSContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		clientConfig := config.Clone()
+		clientConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			return srv.verifyPinnedCertificate(address, state)
+		}
+		dialer := &tls.Dialer{Config: clientConfig}
+		return dialer.DialContext(ctx, network, address)
+	}
+	srv.httpClient = &http.Client{Transport: transport}
+}
+
 func (srv *httpServer) oauthFirst(h http.HandlerFunc, allowedMethod ...string) http.HandlerFunc {
 	return func(wr http.ResponseWriter, r *http.Request) {
 		if !checkAllowedMethod(r.Method, allowedMethod) {
@@ -122,6 +170,7 @@ func (srv *httpServer) loginHandler(wr http.ResponseWriter, r *http.Request) {
 		MaxAge:   maxAge, // expires after 1 day
 		SameSite: http.SameSiteStrictMode,
 		HttpOnly: true,
+		Secure:   srv.tlsConfig != nil,
 	}
 
 	http.SetCookie(wr, &cookie)
@@ -162,12 +211,26 @@ func (srv *httpServer) recordHandler(wr http.ResponseWriter, r *http.Request) {
 
 func (srv *httpServer) dirHandler(wr http.ResponseWriter, r *http.Request) {
 	var resBody []byte
-	mssg := srv.node.ClientDir()
-	if mssg.Status != node.StatusOk {
-		resBody, _ = json.Marshal(&mssg)
-	} else {
-		resBody = []byte(mssg.Content)
+
+	switch r.Method {
+	case http.MethodGet:
+		mssg := srv.node.ClientDir(r.URL.Query().Get("name"))
+		if mssg.Status != node.StatusOk {
+			resBody, _ = json.Marshal(&mssg)
+		} else {
+			resBody = []byte(mssg.Content)
+		}
+
+	case http.MethodPost:
+		resBody, _ = json.Marshal(srv.node.ClientCreateDir(r.URL.Query().Get("name")))
+
+	case http.MethodPut:
+		resBody, _ = json.Marshal(srv.node.ClientRenameDir(r.URL.Query().Get("name"), r.URL.Query().Get("to")))
+
+	case http.MethodDelete:
+		resBody, _ = json.Marshal(srv.node.ClientDeleteDir(r.URL.Query().Get("name")))
 	}
+
 	wr.Write(resBody)
 }
 
@@ -182,28 +245,307 @@ func (srv *httpServer) nodesHandler(wr http.ResponseWriter, r *http.Request) {
 	wr.Write(resBody)
 }
 
+func (srv *httpServer) membersHandler(wr http.ResponseWriter, r *http.Request) {
+	wr.Write([]byte(srv.node.ClientMembers().Content))
+}
+
+func (srv *httpServer) syncHandler(wr http.ResponseWriter, r *http.Request) {
+	wr.Write([]byte(srv.node.ClientSyncStatus().Content))
+}
+
+func (srv *httpServer) outboxHandler(wr http.ResponseWriter, r *http.Request) {
+	wr.Write([]byte(srv.node.ClientOutbox().Content))
+}
+
+func (srv *httpServer) routesHandler(wr http.ResponseWriter, r *http.Request) {
+	wr.Write([]byte(srv.node.ClientRoutes().Content))
+}
+
+func (srv *httpServer) conflictsHandler(wr http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodDelete {
+		resBody, _ := json.Marshal(srv.node.ClientResolveConflict(r.URL.Query().Get("name")))
+		wr.Write(resBody)
+		return
+	}
+	wr.Write([]byte(srv.node.ClientConflicts().Content))
+}
+
 func (srv *httpServer) fileHandler(wr http.ResponseWriter, r *http.Request) {
-	var resBody []byte
+	var mssg *node.MessageBody
 
 	switch r.Method {
 	case http.MethodGet:
-		resBody, _ = json.Marshal(srv.node.ClientReadFile(r.URL.Query().Get("name")))
+		name := r.URL.Query().Get("name")
+		// taken before the read, a stale ETag only makes a later If-Match fail
+		etag := srv.node.FileETag(name)
+		if etag != "" {
+			wr.Header().Set("ETag", etag)
+			if inm := r.Header.Get("If-None-Match"); inm != "" && node.MatchETag(inm, etag) {
+				wr.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+		wr.Header().Set("Accept-Ranges", "bytes")
+		// If-Range asks for the whole file if it changed
+		if ifRange := r.Header.Get("If-Range"); ifRange == "" || ifRange == etag {
+			if offset, length, ok := parseRange(r.Header.Get("Range")); ok {
+				srv.writeFileRange(wr, name, srv.node.ClientReadFileRange(r.Context(), name, node.EncodingBase64, offset, length))
+				return
+			}
+		}
+		srv.writeFileContent(wr, name, srv.node.ClientReadFile(r.Context(), name, node.EncodingBase64))
+		return
 
 	case http.MethodPost:
-		resBody, _ = json.Marshal(srv.node.ClientCreateFile(r.URL.Query().Get("name")))
+		mssg = srv.node.ClientCreateFile(r.URL.Query().Get("name"))
 
 	case http.MethodPut, http.MethodPatch:
 		reqBody, _ := io.ReadAll(http.MaxBytesReader(wr, r.Body, 1<<20))
 		updateCont := node.UpdateFileContent{
-			Name:    r.URL.Query().Get("name"),
-			Content: string(reqBody),
+			Name:        r.URL.Query().Get("name"),
+			Content:     base64.StdEncoding.EncodeToString(reqBody),
+			Encoding:    node.EncodingBase64,
+			IfMatch:     r.Header.Get("If-Match"),
+			IfNoneMatch: r.Header.Get("If-None-Match"),
+		}
+		if r.Method == http.MethodPatch {
+			// appends unless a range is given
+			offset, err := patchOffset(r, int64(len(reqBody)))
+			if err != nil {
+				resBody, _ := json.Marshal(&node.MessageBody{Status: node.StatusBadFormat, Content: err.Error()})
+				wr.WriteHeader(http.StatusBadRequest)
+				wr.Write(resBody)
+				return
+			}
+			updateCont.Offset, updateCont.Append = offset, offset == nil
+		}
+		mssg = srv.node.ClientUpdateFile(r.Context(), updateCont)
+		if mssg.Status == node.StatusOk {
+			wr.Header().Set("ETag", mssg.Content)
 		}
-		resBody, _ = json.Marshal(srv.node.ClientUpdateFile(updateCont))
 
 	case http.MethodDelete:
-		resBody, _ = json.Marshal(srv.node.ClientDeleteFile(r.URL.Query().Get("name")))
+		mssg = srv.node.ClientDeleteFile(r.Context(), node.UpdateFileContent{
+			Name:        r.URL.Query().Get("name"),
+			IfMatch:     r.Header.Get("If-Match"),
+			IfNoneMatch: r.Header.Get("If-None-Match"),
+		})
 	}
 
+	resBody, _ := json.Marshal(mssg)
+	switch mssg.Status {
+	case node.StatusPreconditionFailed:
+		// the content is the current ETag
+		wr.Header().Set("ETag", mssg.Content)
+		wr.WriteHeader(http.StatusPreconditionFailed)
+	case node.StatusBadOffset:
+		// the content is the size of the file
+		wr.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+	}
+	wr.Write(resBody)
+}
+
+// patchOffset returns the offset of a PATCH from "Content-Range: bytes first-last/*" or ?offset, nil if it has none
+func patchOffset(r *http.Request, length int64) (*int64, error) {
+	if cr := r.Header.Get("Content-Range"); cr != "" {
+		var first, last int64
+		var total string
+		if _, err := fmt.Sscanf(cr, "bytes %d-%d/%s", &first, &last, &total); err != nil {
+			return nil, fmt.Errorf("bad Content-Range %q", cr)
+		}
+		if first < 0 || last-first+1 != length {
+			return nil, fmt.Errorf("range %q doesn't match the %d bytes of the body", cr, length)
+		}
+		return &first, nil
+	}
+	if !r.URL.Query().Has("offset") {
+		return nil, nil
+	}
+	offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad offset %q", r.URL.Query().Get("offset"))
+	}
+	return &offset, nil
+}
+
+// parseRange parses a single range of a Range header into an offset and a length for ClientReadFileRange.
+// "bytes=-n" is the last n bytes. Ranges that read the whole file or can't be parsed are ignored
+func parseRange(header string) (int64, int64, bool) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return 0, 0, false
+	}
+	if first == "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		return -n, 0, true
+	}
+	offset, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || offset < 0 {
+		return 0, 0, false
+	}
+	if last == "" {
+		return offset, 0, offset > 0
+	}
+	end, err := strconv.ParseInt(last, 10, 64)
+	if err != nil || end < offset {
+		return 0, 0, false
+	}
+	return offset, end - offset + 1, true
+}
+
+// writeFileRange writes a ranged read as 206 Partial Content
+func (srv *httpServer) writeFileRange(wr http.ResponseWriter, name string, mssg *node.MessageBody) {
+	var cont node.CodeInfoContent
+	var data []byte
+	var err error
+	if mssg.Status == node.StatusOk {
+		if err = json.Unmarshal([]byte(mssg.Content), &cont); err == nil {
+			data, err = base64.StdEncoding.DecodeString(cont.Content)
+		}
+		if err != nil {
+			mssg.Status, mssg.Content = node.StatusInternalError, err.Error()
+		}
+	}
+	if mssg.Status != node.StatusOk {
+		if mssg.Status == node.StatusBadOffset {
+			// the content is the size of the file
+			wr.Header().Set("Content-Range", "bytes */"+mssg.Content)
+		}
+		resBody, _ := json.Marshal(mssg)
+		wr.WriteHeader(httpStatus(mssg.Status))
+		wr.Write(resBody)
+		return
+	}
+
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+	wr.Header().Set("Content-Type", contentType)
+	wr.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	wr.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", cont.Offset, cont.Offset+int64(len(data))-1, cont.Size))
+	wr.WriteHeader(http.StatusPartialContent)
+	wr.Write(data)
+}
+
+// writeFileContent writes the raw content of a base64 read of the file, errors are written as JSON MessageBody
+func (srv *httpServer) writeFileContent(wr http.ResponseWriter, name string, mssg *node.MessageBody) {
+	var data []byte
+	var err error
+	if mssg.Status == node.StatusOk {
+		if data, err = base64.StdEncoding.DecodeString(mssg.Content); err != nil {
+			mssg.Status, mssg.Content = node.StatusInternalError, err.Error()
+		}
+	}
+	if mssg.Status != node.StatusOk {
+		resBody, _ := json.Marshal(mssg)
+		wr.WriteHeader(httpStatus(mssg.Status))
+		wr.Write(resBody)
+		return
+	}
+
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+	wr.Header().Set("Content-Type", contentType)
+	wr.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	wr.Write(data)
+}
+
+// versionsHandler lists the versions of a file, reads one with ?rev or restores one with POST
+func (srv *httpServer) versionsHandler(wr http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	rev, err := strconv.ParseUint(r.URL.Query().Get("rev"), 10, 64)
+	if r.URL.Query().Has("rev") && err != nil {
+		resBody, _ := json.Marshal(&node.MessageBody{Status: node.StatusBadFormat, Content: "rev"})
+		wr.WriteHeader(http.StatusBadRequest)
+		wr.Write(resBody)
+		return
+	}
+
+	var mssg *node.MessageBody
+	switch {
+	case r.Method == http.MethodPost:
+		mssg = srv.node.ClientRestoreVersion(name, rev)
+	case r.URL.Query().Has("rev"):
+		srv.writeFileContent(wr, name, srv.node.ClientReadVersion(name, rev, node.EncodingBase64))
+		return
+	default:
+		mssg = srv.node.ClientVersions(name)
+	}
+	writeMessageBody(wr, mssg)
+}
+
+func (srv *httpServer) versionsDiffHandler(wr http.ResponseWriter, r *http.Request) {
+	from, _ := strconv.ParseUint(r.URL.Query().Get("from"), 10, 64)
+	to, _ := strconv.ParseUint(r.URL.Query().Get("to"), 10, 64)
+	mssg := srv.node.ClientDiffVersions(r.URL.Query().Get("name"), from, to)
+	if mssg.Status != node.StatusOk {
+		writeMessageBody(wr, mssg)
+		return
+	}
+	wr.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	wr.Write([]byte(mssg.Content))
+}
+
+// writeMessageBody writes the content of a successful response, or the response with its HTTP status
+func writeMessageBody(wr http.ResponseWriter, mssg *node.MessageBody) {
+	if mssg.Status != node.StatusOk {
+		resBody, _ := json.Marshal(mssg)
+		wr.WriteHeader(httpStatus(mssg.Status))
+		wr.Write(resBody)
+		return
+	}
+	wr.Write([]byte(mssg.Content))
+}
+
+func (srv *httpServer) streamHandler(wr http.ResponseWriter, r *http.Request) {
+	offset, _ := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	length, _ := strconv.ParseInt(r.URL.Query().Get("length"), 10, 64)
+	mssg, body := srv.node.ClientReadStream(r.Context(), r.URL.Query().Get("name"), offset, length)
+	if body == nil {
+		resBody, _ := json.Marshal(&mssg)
+		wr.WriteHeader(httpStatus(mssg.Status))
+		wr.Write(resBody)
+		return
+	}
+	defer body.Close()
+
+	var chunk node.ChunkContent
+	json.Unmarshal([]byte(mssg.Content), &chunk)
+	wr.Header().Set("Content-Type", "application/octet-stream")
+	wr.Header().Set("Content-Length", strconv.FormatInt(chunk.Length, 10))
+	io.Copy(wr, body)
+}
+
+func (srv *httpServer) uploadHandler(wr http.ResponseWriter, r *http.Request) {
+	chunk := node.ChunkContent{
+		Name:   r.URL.Query().Get("name"),
+		Upload: r.URL.Query().Get("upload"),
+	}
+
+	var mssg *node.MessageBody
+	switch r.Method {
+	case http.MethodGet:
+		// a chunk without body reports how much of the upload was received
+		mssg = srv.node.ClientWriteStream(r.Context(), chunk, nil)
+
+	case http.MethodPut:
+		chunk.Offset, _ = strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+		chunk.Final = r.URL.Query().Get("final") != ""
+		chunk.SHA256 = r.URL.Query().Get("sha256")
+		mssg = srv.node.ClientWriteStream(r.Context(), chunk, r.Body)
+	}
+
+	resBody, _ := json.Marshal(mssg)
 	wr.Write(resBody)
 }
 
@@ -216,6 +558,23 @@ func (srv *httpServer) stopHandler(wr http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// drainHandler hands the files of the node over to other nodes before stopping it
+func (srv *httpServer) drainHandler(wr http.ResponseWriter, r *http.Request) {
+	mssg := srv.node.ClientDrain()
+	resBody, _ := json.Marshal(mssg)
+	if mssg.Status != node.StatusOk {
+		wr.WriteHeader(httpStatus(mssg.Status))
+		wr.Write(resBody)
+		return
+	}
+
+	defer srv.httpServer.Close()
+	wr.Write(resBody)
+	if fl, ok := wr.(http.Flusher); ok {
+		fl.Flush()
+	}
+}
+
 func (srv *httpServer) webDirHandler(wr http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		wr.WriteHeader(http.StatusMethodNotAllowed)
@@ -223,7 +582,8 @@ func (srv *httpServer) webDirHandler(wr http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	reqBody, _ := io.ReadAll(http.MaxBytesReader(wr, r.Body, 1<<20))
+	// base64 file contents grow by a third inside messages
+	reqBody, _ := io.ReadAll(http.MaxBytesReader(wr, r.Body, 2<<20))
 	var mssg node.Message
 	err := json.Unmarshal(reqBody, &mssg)
 	if err != nil {
@@ -232,16 +592,75 @@ func (srv *httpServer) webDirHandler(wr http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !srv.verifyPeerCertificate(r, &mssg) {
+		wr.WriteHeader(http.StatusUnauthorized)
+		wr.Write(webDirFormatResponse(node.StatusNotOauth, "Certificate Required"))
+		return
+	}
+
 	resMssg := srv.node.ClientWebDir(&mssg)
 	resBody, _ := json.Marshal(&resMssg)
 	wr.Write(resBody)
 }
 
+// with mutual TLS, a node must present the certificate it registered with.
+// A forwarded message comes with the certificate of the node that forwarded it
+func (srv *httpServer) verifyPeerCertificate(r *http.Request, mssg *node.Message) bool {
+	if srv.tlsConfig == nil || srv.tlsConfig.ClientCAs == nil {
+		return true
+	}
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return false
+	}
+	peer, ok := srv.node.PeerOf(mssg)
+	return ok && certFingerprint(r.TLS.PeerCertificates[0].Raw) == peer.CertFingerprint
+}
+
+func (srv *httpServer) webDirStreamHandler(wr http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		wr.WriteHeader(http.StatusMethodNotAllowed)
+		wr.Write(webDirFormatBadRequest("Method Not Allowed"))
+		return
+	}
+
+	var mssg node.Message
+	err := json.Unmarshal([]byte(r.Header.Get(webDirMessageHeader)), &mssg)
+	if err != nil {
+		wr.WriteHeader(http.StatusBadRequest)
+		wr.Write(webDirFormatBadRequest("Bad Request"))
+		return
+	}
+
+	if !srv.verifyPeerCertificate(r, &mssg) {
+		wr.WriteHeader(http.StatusUnauthorized)
+		wr.Write(webDirFormatResponse(node.StatusNotOauth, "Certificate Required"))
+		return
+	}
+
+	var reqBody io.Reader = r.Body
+	if r.ContentLength == 0 {
+		reqBody = nil
+	}
+	resMssg, body := srv.node.ClientWebDirStream(r.Context(), &mssg, reqBody)
+	resRaw, _ := json.Marshal(resMssg)
+	wr.Header().Set(webDirMessageHeader, string(resRaw))
+	if body == nil {
+		return
+	}
+	defer body.Close()
+	wr.Header().Set("Content-Type", "application/octet-stream")
+	io.Copy(wr, body)
+}
+
 func webDirFormatBadRequest(content string) []byte {
+	return webDirFormatResponse(node.StatusBadFormat, content)
+}
+
+func webDirFormatResponse(status node.ResponseStatus, content string) []byte {
 	mssg := node.Message{
 		Body: node.MessageBody{
 			Code:    node.CodeResponse,
-			Status:  node.StatusBadFormat,
+			Status:  status,
 			Content: content,
 		},
 	}
@@ -250,15 +669,23 @@ func webDirFormatBadRequest(content string) []byte {
 	return resBody
 }
 
-func webDirMakeHTTPRequest(address string, mssg *node.Message) (*node.Message, error) {
+func (srv *httpServer) webDirMakeHTTPRequest(ctx context.Context, address string, mssg *node.Message) (*node.Message, error) {
 	reqBody, _ := json.Marshal(mssg)
 	newURL := url.URL{
 		Host:   address,
 		Path:   "webdir",
 		Scheme: "http",
 	}
+	if srv.tlsConfig != nil {
+		newURL.Scheme = "https"
+	}
 
-	resp, err := http.Post(newURL.String(), mime.TypeByExtension(".json"), bytes.NewReader(reqBody))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, newURL.String(), bytes.NewReader(reqBody))
+	if err != nil {
+		return &node.Message{}, err
+	}
+	req.Header.Set("Content-Type", mime.TypeByExtension(".json"))
+	resp, err := srv.httpClient.Do(req)
 	if err != nil {
 		log.Println("webDirMakeHTTPRequest http post failed")
 		return &node.Message{}, err
@@ -276,6 +703,67 @@ func webDirMakeHTTPRequest(address string, mssg *node.Message) (*node.Message, e
 	return &resMssg, err
 }
 
+func (srv *httpServer) webDirMakeStreamRequest(ctx context.Context, address string, mssg *node.Message, body io.Reader) (*node.Message, io.ReadCloser, error) {
+	newURL := url.URL{
+		Host:   address,
+		Path:   "webdir/stream",
+		Scheme: "http",
+	}
+	if srv.tlsConfig != nil {
+		newURL.Scheme = "https"
+	}
+	if body == nil {
+		body = http.NoBody
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, newURL.String(), body)
+	if err != nil {
+		return &node.Message{}, nil, err
+	}
+	reqRaw, _ := json.Marshal(mssg)
+	req.Header.Set(webDirMessageHeader, string(reqRaw))
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := srv.httpClient.Do(req)
+	if err != nil {
+		log.Println("webDirMakeStreamRequest http post failed")
+		return &node.Message{}, nil, err
+	}
+
+	var resMssg node.Message
+	if err := json.Unmarshal([]byte(resp.Header.Get(webDirMessageHeader)), &resMssg); err != nil {
+		resp.Body.Close()
+		return &node.Message{}, nil, err
+	}
+	return &resMssg, resp.Body, nil
+}
+
+// httpStatus maps a node response status to the HTTP status of client routes that don't answer with JSON
+func httpStatus(status node.ResponseStatus) int {
+	switch status {
+	case node.StatusOk:
+		return http.StatusOK
+	case node.StatusFileNotFound, node.StatusDirNotFound:
+		return http.StatusNotFound
+	case node.StatusBadFileName, node.StatusBadFormat, node.StatusIsDir:
+		return http.StatusBadRequest
+	case node.StatusBadOffset:
+		return http.StatusRequestedRangeNotSatisfiable
+	case node.StatusNodeNotOnline, node.StatusNoRoute:
+		return http.StatusBadGateway
+	case node.StatusNodeDraining:
+		return http.StatusServiceUnavailable
+	case node.StatusFileConflict:
+		return http.StatusConflict
+	case node.StatusPreconditionFailed:
+		return http.StatusPreconditionFailed
+	case node.StatusChecksumMismatch:
+		return http.StatusBadGateway
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
 func checkAllowedMethod(method string, allowed []string) bool {
 	if len(allowed) == 0 {
 		return true
@@ -1,43 +1,82 @@
 package main
 
 import (
+	"crypto/x509"
 	"flag"
 	"log"
 	"net"
+	"os"
+	"time"
 
 	"github.com/urbanishimwe/webdir/node"
 )
 
 var (
-	addr, mesh, publicAddr, username, password, httpPassword string
+	addr, mesh, publicAddr, username, httpPassword  string
+	tlsFlags                                        tlsFiles
+	replicas, versions, retries, fanOut, neighbours int
+	requestTimeout, batchWindow                     time.Duration
+	storage                                         string
+	s3Flags                                         node.S3Storage
 )
 
 func init() {
 	flag.StringVar(&addr, "addr", "", "Address and port for the node server. If empty, random port is used and server listen on all available address")
-	flag.StringVar(&mesh, "mesh", "", "Address of the mesh initiator for registering to the network. If empty this node is the mesh initiator")
+	flag.StringVar(&mesh, "mesh", "", "Comma-separated addresses of mesh nodes for registering to the network, tried in order. If empty this node is the mesh initiator")
 	flag.StringVar(&publicAddr, "public-addr", "", "Internet address for this network if not specified node address is used instead")
 	flag.StringVar(&username, "name", "", "username of the node, if empty random text are used")
-	flag.StringVar(&password, "password", "", "password of the node, if empty random text are used")
 	flag.StringVar(&httpPassword, "http-password", "", "password for the client")
+	flag.IntVar(&replicas, "replicas", 0, "number of other nodes keeping a copy of each file owned by this node, reads fall back to them when this node is gone")
+	flag.IntVar(&versions, "versions", 10, "number of past versions kept for each file owned by this node")
+	flag.DurationVar(&requestTimeout, "request-timeout", 10*time.Second, "deadline of every message sent to another node")
+	flag.IntVar(&retries, "retries", 3, "number of times reads, pings and other idempotent messages are sent again after a network error, with exponential backoff")
+	flag.IntVar(&fanOut, "fanout", 32, "number of nodes messaged at once by a broadcast or waiting for updates")
+	flag.IntVar(&neighbours, "neighbours", 0, "number of nodes messaged directly, picked by their connection score. Messages for the other nodes are forwarded by them, 0 messages every node directly")
+	flag.DurationVar(&batchWindow, "batch-window", 5*time.Millisecond, "updates made within this window are sent to a node in one message")
+	flag.StringVar(&storage, "storage", "local", "where owned files are kept: local($HOME/webdir), memory(lost when the node stops) or s3")
+	flag.StringVar(&s3Flags.Endpoint, "s3-endpoint", "", "URL of the S3 compatible server used by -storage=s3, AWS if empty. Credentials are read from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN")
+	flag.StringVar(&s3Flags.Bucket, "s3-bucket", "", "bucket used by -storage=s3")
+	flag.StringVar(&s3Flags.Region, "s3-region", "us-east-1", "region of -s3-bucket")
+	flag.StringVar(&s3Flags.Prefix, "s3-prefix", "", "prefix of the objects kept in -s3-bucket, nodes sharing a bucket need different prefixes")
+	flag.StringVar(&tlsFlags.cert, "tls-cert", "", "PEM certificate file, if set the node serves HTTPS and presents it to other nodes")
+	flag.StringVar(&tlsFlags.key, "tls-key", "", "PEM private key file of -tls-cert")
+	flag.StringVar(&tlsFlags.ca, "tls-ca", "", "PEM CA file used to verify other nodes, if set nodes must authenticate with certificates(mutual TLS)")
+	flag.StringVar(&tlsFlags.bootstrap, "tls-bootstrap", "", "directory of a local CA shared by a test mesh, it is created if missing and signs a certificate for this node. Replaces the other -tls flags")
 	flag.Parse()
 }
 
 func main() {
 	httpSrv := mustNewHttpServer(addr)
+	nodeAddr := httpSrv.httpServer.Addr().String()
+	httpSrv.setTLSConfig(mustLoadTLSConfig(tlsFlags, bootstrapCertName(nodeAddr), tlsHosts(publicAddr, nodeAddr)))
 	temp := buildTempNodeConfig(httpSrv)
-	httpSrv.node = node.MustInitServer(temp, mesh, webDirMakeHTTPRequest)
+	temp.StreamClient = httpSrv.webDirMakeStreamRequest
+	httpSrv.node = node.MustInitServer(temp, mesh, httpSrv.webDirMakeHTTPRequest)
 	httpSrv.clientPassword = httpPassword
 	httpSrv.listenAndServe()
 }
 
 func buildTempNodeConfig(srv *httpServer) node.NodeConfig {
-	tempConfig := node.NodeConfig{}
+	tempConfig := node.NodeConfig{
+		ReplicationFactor: replicas,
+		MaxVersions:       versions,
+		Storage:           mustBuildStorage(),
+		RequestTimeout:    requestTimeout,
+		Retry:             node.RetryPolicy{Retries: retries},
+		FanOut:            fanOut,
+		BatchWindow:       batchWindow,
+		MaxNeighbours:     neighbours,
+	}
 	if username != "" {
 		tempConfig.Node.Oauth.UserName = username
 	}
 
-	if password != "" {
-		tempConfig.Node.Oauth.Password = password
+	if srv.tlsConfig != nil {
+		cert, err := x509.ParseCertificate(srv.tlsConfig.Certificates[0].Certificate[0])
+		if err != nil {
+			log.Fatalf("Parsing TLS certificate failed: %q", err)
+		}
+		tempConfig.Node.CertFingerprint = certFingerprint(cert.Raw)
 	}
 
 	if publicAddr == "" {
@@ -50,3 +89,24 @@ func buildTempNodeConfig(srv *httpServer) node.NodeConfig {
 
 	return tempConfig
 }
+
+// mustBuildStorage returns the storage of -storage, nil is the default local storage
+func mustBuildStorage() node.Storage {
+	switch storage {
+	case "local":
+		return nil
+	case "memory":
+		return &node.MemoryStorage{}
+	case "s3":
+		if s3Flags.Bucket == "" {
+			log.Fatalf("-storage=s3 needs -s3-bucket")
+		}
+		s3Flags.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		s3Flags.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		s3Flags.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+		s3Flags.Timeout = requestTimeout
+		return &s3Flags
+	}
+	log.Fatalf("Unknown storage %q", storage)
+	return nil
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// TLS FOR NODE-TO-NODE TRAFFIC
+//
+// With -tls-cert/-tls-key the server speaks HTTPS and the same certificate is presented to other nodes as client certificate.
+// With -tls-ca both sides verify each other against that CA(mutual TLS), nodes must then present a certificate on /webdir.
+// With -tls-bootstrap a local CA is created(or reused) in the given directory and signs a certificate for this node,
+// nodes of a test mesh only need to share that directory. The certificate is found again after a restart by the name
+// of the node, or by -addr, so a bootstrapped node needs one of them.
+//
+// The fingerprint of a node's certificate is recorded in the online nodes record, later connections must present the same one.
+
+type tlsFiles struct {
+	cert, key, ca, bootstrap string
+}
+
+func (f tlsFiles) enabled() bool {
+	return f.bootstrap != "" || f.cert != ""
+}
+
+// mustLoadTLSConfig returns nil if TLS is not configured. name identifies the node certificate in bootstrap mode
+func mustLoadTLSConfig(files tlsFiles, name string, hosts []string) *tls.Config {
+	if !files.enabled() {
+		return nil
+	}
+
+	if files.bootstrap != "" {
+		var err error
+		files, err = bootstrapLocalCA(files.bootstrap, name, hosts)
+		if err != nil {
+			log.Fatalf("Bootstrapping local CA in %q failed: %q", files.bootstrap, err)
+		}
+	}
+
+	cert, err := tls.LoadX509KeyPair(files.cert, files.key)
+	if err != nil {
+		log.Fatalf("Loading TLS certificate failed: %q", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if files.ca != "" {
+		caRaw, err := os.ReadFile(files.ca)
+		if err != nil {
+			log.Fatalf("Reading CA file failed: %q", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caRaw) {
+			log.Fatalf("No certificate found in CA file %q", files.ca)
+		}
+		config.RootCAs = pool
+		config.ClientCAs = pool
+		// browsers talking to the client routes don't have certificates, /webdir checks for it
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config
+}
+
+func certFingerprint(raw []byte) string {
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// bootstrapCertName names the certificate of the node in bootstrap mode: -name, or the listen address if it was set
+// with -addr. A random port would give the node a new certificate, and fingerprint, on every restart
+func bootstrapCertName(listenAddr string) string {
+	if tlsFlags.bootstrap == "" {
+		return ""
+	}
+	if username != "" {
+		return username
+	}
+	if addr == "" {
+		log.Fatalf("-tls-bootstrap needs -name or -addr to find the certificate of the node again after a restart")
+	}
+	return listenAddr
+}
+
+// bootstrapLocalCA creates the CA in dir if it does not exist and signs a certificate for hosts
+// the node certificate is kept as node-$name.pem so its fingerprint survives restarts
+func bootstrapLocalCA(dir, name string, hosts []string) (tlsFiles, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return tlsFiles{}, err
+	}
+	files := tlsFiles{
+		ca:   filepath.Join(dir, "ca.pem"),
+		cert: filepath.Join(dir, "node-"+fileSafe(name)+".pem"),
+		key:  filepath.Join(dir, "node-"+fileSafe(name)+"-key.pem"),
+	}
+	caKeyFile := filepath.Join(dir, "ca-key.pem")
+
+	if _, err := os.Stat(files.ca); os.IsNotExist(err) {
+		log.Printf("Creating local CA in %q\n", dir)
+		template := &x509.Certificate{
+			SerialNumber:          randomSerial(),
+			Subject:               pkix.Name{CommonName: "webdir local CA"},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().AddDate(10, 0, 0),
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}
+		if err := writeCertificate(template, nil, nil, files.ca, caKeyFile); err != nil {
+			return files, err
+		}
+	}
+
+	if _, err := os.Stat(files.cert); err == nil {
+		return files, nil
+	}
+
+	caPair, err := tls.LoadX509KeyPair(files.ca, caKeyFile)
+	if err != nil {
+		return files, err
+	}
+	caCert, err := x509.ParseCertificate(caPair.Certificate[0])
+	if err != nil {
+		return files, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject:      pkix.Name{CommonName: "webdir node"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+	log.Printf("Signing node certificate for %v\n", hosts)
+	return files, writeCertificate(template, caCert, caPair.PrivateKey, files.cert, files.key)
+}
+
+// writeCertificate signs template with parentKey, it is self-signed if parent is nil
+func writeCertificate(template, parent *x509.Certificate, parentKey any, certFile, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return err
+	}
+	return os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+}
+
+func randomSerial() *big.Int {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return big.NewInt(time.Now().UnixNano())
+	}
+	return serial
+}
+
+// tlsHosts returns the host names a node certificate is valid for
+func tlsHosts(addresses ...string) []string {
+	hosts := []string{}
+	for _, addr := range addresses {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil || host == "" || net.ParseIP(host).IsUnspecified() {
+			continue
+		}
+		hosts = append(hosts, host)
+	}
+	if len(hosts) == 0 {
+		hosts = append(hosts, "localhost", "127.0.0.1", "::1")
+	}
+	return hosts
+}
+
+func fileSafe(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '.' || r == '-' || r == '_' || (r >= '0' && r <= '9') || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+var errPinnedCertificate = errors.New("certificate does not match the fingerprint pinned for the node")
+
+// verifyPinnedCertificate checks the certificate of the node listening at address against the record
+func (srv *httpServer) verifyPinnedCertificate(address string, state tls.ConnectionState) error {
+	if srv.node == nil || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	n, ok := srv.node.NodeByAddress(address)
+	if !ok || n.CertFingerprint == "" {
+		return nil
+	}
+	if certFingerprint(state.PeerCertificates[0].Raw) != n.CertFingerprint {
+		return errPinnedCertificate
+	}
+	return nil
+}
@@ -0,0 +1,311 @@
+package node
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ANTI-ENTROPY REPAIRS WHAT LOST UPDATES LEFT BEHIND
+//
+// Every syncInterval a node compares Directory.FilesList with a random peer using a two level hash tree:
+// files are hashed into digestBuckets buckets and the root is the hash of the buckets.
+//  1. CodeDigest with the root and the buckets, the peer answers the buckets that differ with the hash of each of its files in them
+//  2. CodeDigest with the names that differ, the peer answers those files
+//
+// A pulled file replaces ours if its version dominates(resolveFile). A file the peer doesn't have is only removed
+// if the peer is its owner, the owner knows best.
+// A deleted file leaves a tombstone for tombstoneTTL, a pulled file its tombstone dominates was deleted here
+// after the peer saw it and is not brought back. Tombstones are kept in the state store with the record.
+
+const (
+	syncInterval  = 15 * time.Second
+	digestBuckets = 64
+	tombstoneTTL  = time.Hour
+)
+
+// tombstone is what is left of a deleted file: its name, owner, creation and version vector
+type tombstone struct {
+	File      File      `json:"file"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+// used internally
+type DigestContent struct {
+	Root    string   `json:"root,omitempty"`
+	Buckets []string `json:"buckets,omitempty"`
+	// buckets that differ and the hash of every file of the responder in them
+	Differ  []int             `json:"differ,omitempty"`
+	Entries map[string]string `json:"entries,omitempty"`
+	// files requested and the files sent back
+	Names []string `json:"names,omitempty"`
+	Files []File   `json:"files,omitempty"`
+}
+
+// SyncStatus is the result of the last anti-entropy round with a peer
+type SyncStatus struct {
+	At      time.Time `json:"at"`
+	InSync  bool      `json:"in_sync"`
+	Pulled  int       `json:"pulled"`
+	Removed int       `json:"removed"`
+	Error   string    `json:"error,omitempty"`
+}
+
+type syncStatuses struct {
+	mx    sync.Mutex
+	peers map[string]SyncStatus
+}
+
+// ClientSyncStatus returns the last sync status with each peer
+func (node *NodeConfig) ClientSyncStatus() *MessageBody {
+	node.syncs.mx.Lock()
+	defer node.syncs.mx.Unlock()
+	resBody, _ := json.Marshal(node.syncs.peers)
+	return messageBodyFormat(CodeNone, StatusOk, string(resBody))
+}
+
+func (node *NodeConfig) HandleCodeDigest(mssg *Message) *Message {
+	var req DigestContent
+	if err := json.Unmarshal([]byte(mssg.Body.Content), &req); err != nil {
+		return responseFormat(node, mssg, StatusBadFormat, true, err.Error())
+	}
+
+	var res DigestContent
+	if len(req.Names) > 0 {
+		for _, name := range req.Names {
+			if f, ok := node.getFile(name); ok {
+				res.Files = append(res.Files, f)
+			}
+		}
+	} else {
+		digest := node.directoryDigest()
+		res.Root = digest.root
+		if len(req.Buckets) != digestBuckets {
+			return responseFormat(node, mssg, StatusBadFormat, true, "")
+		}
+		if req.Root != digest.root {
+			res.Entries = map[string]string{}
+			for i, hash := range digest.buckets {
+				if hash == req.Buckets[i] {
+					continue
+				}
+				res.Differ = append(res.Differ, i)
+				for name, entry := range digest.entries[i] {
+					res.Entries[name] = entry
+				}
+			}
+		}
+	}
+
+	resBody, _ := json.Marshal(&res)
+	return responseFormat(node, mssg, StatusOk, true, string(resBody))
+}
+
+func nodeAntiEntropy(node *NodeConfig) {
+	ticker := time.NewTicker(syncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			pruneTombstones(node)
+			peers := copyNodesAddress(node)
+			if len(peers) > 0 {
+				syncWith(node, peers[rand.Intn(len(peers))])
+			}
+		case <-node.stopNode:
+			return
+		}
+	}
+}
+
+// syncWith runs one anti-entropy round with peer and records its status
+func syncWith(node *NodeConfig, peer Node) {
+	status := SyncStatus{At: time.Now()}
+	defer func() {
+		node.syncs.mx.Lock()
+		node.syncs.peers[peer.Oauth.UserName] = status
+		node.syncs.mx.Unlock()
+	}()
+
+	digest := node.directoryDigest()
+	var res DigestContent
+	if err := node.digestRequest(peer, &DigestContent{Root: digest.root, Buckets: digest.buckets[:]}, &res); err != nil {
+		status.Error = err.Error()
+		return
+	}
+	if res.Root == digest.root {
+		status.InSync = true
+		return
+	}
+
+	pull := []string{}
+	for _, i := range res.Differ {
+		if i < 0 || i >= digestBuckets {
+			continue
+		}
+		for name, hash := range res.Entries {
+			if digestBucket(name) == i && digest.entries[i][name] != hash {
+				pull = append(pull, name)
+			}
+		}
+		for name := range digest.entries[i] {
+			if _, ok := res.Entries[name]; ok {
+				continue
+			}
+			// the owner doesn't have it anymore, a delete was lost
+			if f, ok := node.getFile(name); ok && f.Owner == peer.Oauth.UserName {
+				log.Printf("(syncWith) removing %q, its owner(%s) no longer has it\n", name, peer.Oauth.UserName)
+				node.writeMx.Lock()
+				node.deleteFile(name, updateTimeNow(CodeDeleteFile, peer.Oauth.UserName, ""))
+				deleteReplica(node, f)
+				deleteVersions(node, f)
+				node.writeMx.Unlock()
+				status.Removed++
+			}
+		}
+	}
+	if len(pull) == 0 {
+		return
+	}
+
+	sort.Strings(pull)
+	res = DigestContent{}
+	if err := node.digestRequest(peer, &DigestContent{Names: pull}, &res); err != nil {
+		status.Error = err.Error()
+		return
+	}
+	for _, f := range res.Files {
+		if name, err := ParseFileName(f.Name); err != nil || string(name) != f.Name {
+			continue
+		}
+		if node.buried(f) {
+			continue
+		}
+		node.observe(f.RecentUpdate.Clock)
+		kept := f
+		if local, ok := node.getFile(f.Name); ok {
+			var remote bool
+			var res ResponseStatus
+			kept, remote, res = node.resolveFile(local, f)
+			if !remote {
+				if res == StatusFileConflict {
+					// the merged version vector
+					node.createFile(kept)
+				}
+				continue
+			}
+		}
+		log.Printf("(syncWith) pulled %q from node(%s)\n", f.Name, peer.Oauth.UserName)
+		node.createFile(kept)
+		status.Pulled++
+	}
+}
+
+// bury leaves a tombstone of f and returns what it keeps of f, dirsRwMx must be held
+func (node *NodeConfig) bury(f File) File {
+	buried := tombstoneFile(f)
+	node.tombstones[f.Name] = tombstone{File: buried, DeletedAt: time.Now()}
+	return buried
+}
+
+// tombstoneFile is what a tombstone keeps of f
+func tombstoneFile(f File) File {
+	return File{
+		Name:      f.Name,
+		Owner:     f.Owner,
+		CreatedAt: f.CreatedAt,
+		Creator:   f.Creator,
+		Versions:  mergeVersions(f.Versions, nil),
+	}
+}
+
+// buried tells whether f was deleted here since that version
+func (node *NodeConfig) buried(f File) bool {
+	node.dirsRwMx.RLock()
+	t, ok := node.tombstones[f.Name]
+	node.dirsRwMx.RUnlock()
+	if !ok {
+		return false
+	}
+	order := compareVersions(f, t.File)
+	return order == versionBefore || order == versionEqual
+}
+
+func pruneTombstones(node *NodeConfig) {
+	node.dirsRwMx.Lock()
+	defer node.dirsRwMx.Unlock()
+	for name, t := range node.tombstones {
+		if time.Since(t.DeletedAt) > tombstoneTTL {
+			delete(node.tombstones, name)
+		}
+	}
+}
+
+func (node *NodeConfig) digestRequest(peer Node, req *DigestContent, res *DigestContent) error {
+	reqRaw, _ := json.Marshal(req)
+	mssg := Message{
+		Header: MessageHeader{
+			Node:        node.Node,
+			Destination: peer.Oauth.UserName,
+		},
+		Body: *messageBodyFormat(CodeDigest, "", string(reqRaw)),
+	}
+	resMssg, err := node.send(context.Background(), peer.Address, &mssg)
+	if err != nil {
+		return err
+	}
+	if resMssg.Body.Status != StatusOk {
+		return errors.New(string(resMssg.Body.Status))
+	}
+	return json.Unmarshal([]byte(resMssg.Body.Content), res)
+}
+
+type directoryDigest struct {
+	root    string
+	buckets [digestBuckets]string
+	// hash of every file, by bucket
+	entries [digestBuckets]map[string]string
+}
+
+func (node *NodeConfig) directoryDigest() directoryDigest {
+	var digest directoryDigest
+	for i := range digest.entries {
+		digest.entries[i] = map[string]string{}
+	}
+	node.dirsRwMx.RLock()
+	for name, f := range node.Record.Directory.FilesList {
+		raw, _ := json.Marshal(&f)
+		sum := sha256.Sum256(raw)
+		digest.entries[digestBucket(name)][name] = hex.EncodeToString(sum[:])
+	}
+	node.dirsRwMx.RUnlock()
+
+	root := sha256.New()
+	for i, entries := range digest.entries {
+		names := make([]string, 0, len(entries))
+		for name := range entries {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		bucket := sha256.New()
+		for _, name := range names {
+			bucket.Write([]byte(name + "\x00" + entries[name] + "\n"))
+		}
+		digest.buckets[i] = hex.EncodeToString(bucket.Sum(nil))
+		root.Write([]byte(digest.buckets[i]))
+	}
+	digest.root = hex.EncodeToString(root.Sum(nil))
+	return digest
+}
+
+func digestBucket(name string) int {
+	sum := sha256.Sum256([]byte(name))
+	return int(sum[0]) % digestBuckets
+}
@@ -0,0 +1,98 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+// a peer that missed the deletion of f and still has it
+type staleSyncPeer struct {
+	f File
+}
+
+func (peer *staleSyncPeer) netClient(ctx context.Context, remoteAddr string, message *Message) (*Message, error) {
+	var req DigestContent
+	json.Unmarshal([]byte(message.Body.Content), &req)
+	raw, _ := json.Marshal(&peer.f)
+	res := DigestContent{
+		Root:    "peer",
+		Differ:  []int{digestBucket(peer.f.Name)},
+		Entries: map[string]string{peer.f.Name: string(raw)},
+	}
+	if len(req.Names) > 0 {
+		res = DigestContent{Files: []File{peer.f}}
+	}
+	resRaw, _ := json.Marshal(&res)
+	return signedBy(peerKey, "peer", &Message{Body: *messageBodyFormat(CodeResponse, StatusOk, string(resRaw))}), nil
+}
+
+func TestSyncWithTombstone(t *testing.T) {
+	peer := &staleSyncPeer{}
+	temp := NodeConfig{
+		BaseFilePath:   t.TempDir(),
+		Storage:        &MemoryStorage{},
+		PublicAddr:     &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1},
+		RequestTimeout: time.Second,
+	}
+	temp.Node.Oauth.UserName = "sync"
+	temp.Record.OnlineNodes.NodesList = map[string]Node{}
+	n := MustInitServer(temp, "", peer.netClient)
+	t.Cleanup(n.Stop)
+	other := Node{Address: "peer", Oauth: Oauth{UserName: "peer"}}
+
+	if m := n.ClientCreateFile("gone.txt"); m.Status != StatusOk {
+		t.Fatal(m.Status)
+	}
+	peer.f, _ = n.getFile("gone.txt")
+	n.deleteFile("gone.txt", updateTimeNow(CodeDeleteFile, "sync", ""))
+
+	syncWith(n, other)
+	if _, ok := n.getFile("gone.txt"); ok {
+		t.Fatal("deleted file pulled back from a peer that missed the delete")
+	}
+
+	// a change made after the delete is not covered by the tombstone
+	peer.f.Versions = mergeVersions(peer.f.Versions, map[string]uint64{"peer": 1})
+	syncWith(n, other)
+	if _, ok := n.getFile("gone.txt"); !ok {
+		t.Fatal("file changed after its delete was not pulled")
+	}
+
+	n.tombstones["gone.txt"] = tombstone{DeletedAt: time.Now().Add(-tombstoneTTL - time.Minute)}
+	pruneTombstones(n)
+	if _, ok := n.tombstones["gone.txt"]; ok {
+		t.Fatal("expired tombstone kept")
+	}
+}
+
+func TestTombstoneStore(t *testing.T) {
+	n := newStreamTestNode(t, nil)
+	if m := n.ClientCreateFile("gone.txt"); m.Status != StatusOk {
+		t.Fatal(m.Status)
+	}
+	f, _ := n.getFile("gone.txt")
+	n.deleteFile("gone.txt", updateTimeNow(CodeDeleteFile, "stream", ""))
+
+	// replayed from the log, then read from the snapshot
+	for _, compact := range []bool{false, true} {
+		if compact {
+			if err := compactState(n); err != nil {
+				t.Fatal(err)
+			}
+		}
+		state, _, err := loadState(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buried, ok := state.Tombstones["gone.txt"]
+		if !ok {
+			t.Fatalf("tombstone lost(compacted %v)", compact)
+		}
+		if order := compareVersions(f, buried.File); order != versionEqual {
+			t.Fatalf("tombstone of another version(compacted %v)", compact)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package node
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+)
+
+// NODES AUTHENTICATE WITH SIGNED MESSAGES
+//
+// Every node holds an Ed25519 keypair and registers its public key with CodeRegister.
+// Each message is signed over its JSON form(without the signature), the header carries a timestamp and a nonce
+// so a captured message can't be replayed: messages older than messageMaxAge or with a nonce already seen are rejected.
+
+const messageMaxAge = 30 * time.Second
+
+var errBadSignature = errors.New("message signature verification failed")
+
+func generateKey() (ed25519.PrivateKey, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	return key, err
+}
+
+func encodePublicKey(key ed25519.PrivateKey) string {
+	return base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+}
+
+// signMessage stamps mssg with a timestamp, a nonce and pending membership updates and signs it with the key of the node
+func (node *NodeConfig) signMessage(mssg *Message) {
+	mssg.Header.Timestamp = time.Now()
+	mssg.Header.Nonce = randomText()
+	mssg.Header.Gossip = node.piggyback()
+	mssg.Header.Signature = ""
+	unsigned := *mssg
+	unsigned.Header.TTL, unsigned.Header.Hops = 0, nil
+	raw, _ := json.Marshal(&unsigned)
+	mssg.Header.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(node.privateKey, raw))
+}
+
+// verifyMessage checks the signature of mssg against publicKey and rejects stale or replayed messages
+func (node *NodeConfig) verifyMessage(mssg *Message, publicKey string) bool {
+	key, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return false
+	}
+	signature, err := base64.StdEncoding.DecodeString(mssg.Header.Signature)
+	if err != nil {
+		return false
+	}
+
+	unsigned := *mssg
+	unsigned.Header.Signature = ""
+	unsigned.Header.TTL, unsigned.Header.Hops = 0, nil
+	raw, _ := json.Marshal(&unsigned)
+	if !ed25519.Verify(ed25519.PublicKey(key), raw, signature) {
+		return false
+	}
+
+	age := time.Since(mssg.Header.Timestamp)
+	if age > messageMaxAge || age < -messageMaxAge {
+		return false
+	}
+	return node.useNonce(mssg.Header.Nonce)
+}
+
+// verifyResponse checks that resMssg, the response to mssg sent to address, is signed by the node mssg was addressed to
+// or by the node at address(the first hop of a routed message), a later hop may only answer StatusNoRoute.
+// A node we don't know yet, the one a new node registers through, can only be checked against the key it sends
+func (node *NodeConfig) verifyResponse(address string, mssg, resMssg *Message) bool {
+	signer := resMssg.Header.Node.Oauth.UserName
+	signers := []Node{}
+	if n, ok := node.getNode(mssg.Header.Destination); ok {
+		signers = append(signers, n)
+	}
+	if n, ok := node.NodeByAddress(address); ok && n.Oauth.UserName != mssg.Header.Destination {
+		signers = append(signers, n)
+	}
+	if n, ok := node.getNode(signer); ok && mssg.Header.TTL > 0 && resMssg.Body.Status == StatusNoRoute {
+		signers = append(signers, n)
+	}
+
+	if len(signers) == 0 {
+		if mssg.Header.Destination != "" && signer != mssg.Header.Destination {
+			return false
+		}
+		return resMssg.Header.Node.PublicKey != "" && node.verifyMessage(resMssg, resMssg.Header.Node.PublicKey)
+	}
+	for _, n := range signers {
+		// replies refusing a message don't name their sender
+		if (signer == "" || signer == n.Oauth.UserName) && node.verifyMessage(resMssg, n.PublicKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// useNonce returns false if nonce was already used
+func (node *NodeConfig) useNonce(nonce string) bool {
+	node.noncesMx.Lock()
+	defer node.noncesMx.Unlock()
+	if _, ok := node.nonces[nonce]; ok || nonce == "" {
+		return false
+	}
+
+	now := time.Now()
+	for n, at := range node.nonces {
+		// older messages are rejected by their timestamp anyway
+		if now.Sub(at) > 2*messageMaxAge {
+			delete(node.nonces, n)
+		}
+	}
+	node.nonces[nonce] = now
+	return true
+}
+
+// send signs a copy of mssg, sends it through NetClient(to the next hop if its destination is not a neighbour)
+// and verifies the response of known nodes.
+// Every attempt expires after RequestTimeout, idempotent codes are retried as told by the Retry policy
+func (node *NodeConfig) send(ctx context.Context, address string, mssg *Message) (*Message, error) {
+	retries := 0
+	if mssg.Body.Code.idempotent() {
+		retries = node.Retry.Retries
+	}
+	// a failed attempt may have dropped the link it went through, the route is computed again
+	attempt := func() (*Message, error) {
+		signed := *mssg
+		return node.sendOnce(ctx, node.route(address, &signed), signed)
+	}
+	resMssg, err := attempt()
+	for retry := 0; retry < retries && err != nil && retryable(ctx, err); retry++ {
+		if !sleepContext(ctx, node.Retry.backoff(retry)) {
+			break
+		}
+		log.Printf("(send) retrying %s to %s after: %q\n", mssg.Body.Code, address, err)
+		resMssg, err = attempt()
+	}
+	return resMssg, err
+}
+
+// sendOnce signs mssg and sends it a single time
+func (node *NodeConfig) sendOnce(ctx context.Context, address string, mssg Message) (*Message, error) {
+	callCtx := ctx
+	ctx, cancel := context.WithTimeout(ctx, node.RequestTimeout)
+	defer cancel()
+	node.signMessage(&mssg)
+
+	start := time.Now()
+	resMssg, err := node.NetClient(ctx, address, &mssg)
+	if mssg.Header.TTL == 0 && callCtx.Err() == nil {
+		node.observeLink(mssg.Header.Destination, time.Since(start), err != nil)
+	}
+	if err != nil || resMssg == nil {
+		return resMssg, err
+	}
+
+	if !node.verifyResponse(address, &mssg, resMssg) {
+		return &Message{}, errBadSignature
+	}
+	if _, ok := node.getNode(resMssg.Header.Node.Oauth.UserName); ok {
+		node.receiveGossip(resMssg)
+	}
+	if mssg.Header.TTL > 0 && resMssg.Body.Status == StatusNoRoute {
+		return resMssg, errNoRoute
+	}
+	return resMssg, nil
+}
@@ -0,0 +1,59 @@
+package node
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestVerifyResponse(t *testing.T) {
+	otherKey, _ := generateKey()
+	temp := NodeConfig{
+		BaseFilePath:   t.TempDir(),
+		Storage:        &MemoryStorage{},
+		PublicAddr:     &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1},
+		RequestTimeout: time.Second,
+	}
+	temp.Node.Oauth.UserName = "auth"
+	temp.Record.OnlineNodes.NodesList = map[string]Node{
+		"peer":  {Address: "peer:1", PublicKey: encodePublicKey(peerKey), Oauth: Oauth{UserName: "peer"}},
+		"other": {Address: "other:1", PublicKey: encodePublicKey(otherKey), Oauth: Oauth{UserName: "other"}},
+	}
+	var reply func() *Message
+	n := MustInitServer(temp, "", func(ctx context.Context, remoteAddr string, message *Message) (*Message, error) {
+		return reply(), nil
+	})
+	t.Cleanup(n.Stop)
+
+	ok := func() *Message { return &Message{Body: *messageBodyFormat(CodeResponse, StatusOk, "")} }
+	tests := []struct {
+		name    string
+		address string
+		reply   func() *Message
+		valid   bool
+	}{
+		{"signed by the destination", "peer:1", func() *Message { return signedBy(peerKey, "peer", ok()) }, true},
+		{"refusal without sender", "peer:1", func() *Message { return signedBy(peerKey, "", ok()) }, true},
+		{"unsigned", "peer:1", ok, false},
+		{"unsigned without sender", "peer:1", func() *Message { return &Message{} }, false},
+		{"signed by another node", "peer:1", func() *Message { return signedBy(otherKey, "other", ok()) }, false},
+		{"signed by an unknown node claiming the destination", "peer:1", func() *Message {
+			key, _ := generateKey()
+			return signedBy(key, "peer", ok())
+		}, false},
+		{"unknown node signing with its own key", "new:1", func() *Message {
+			key, _ := generateKey()
+			return signedBy(key, "new", ok())
+		}, true},
+		{"unknown node without key", "new:1", ok, false},
+	}
+	for _, tt := range tests {
+		reply = tt.reply
+		mssg := &Message{Header: MessageHeader{Node: n.Node}, Body: *messageBodyFormat(CodePing, "", "")}
+		_, err := n.sendOnce(context.Background(), n.route(tt.address, mssg), *mssg)
+		if valid := err == nil; valid != tt.valid {
+			t.Errorf("%s: got error %v", tt.name, err)
+		}
+	}
+}
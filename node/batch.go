@@ -0,0 +1,211 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+)
+
+// UPDATES ARE SENT IN BATCHES AND MEMBERSHIP AS DELTAS
+//
+// An outbox waits BatchWindow after an update was queued, then every update waiting for its peer(at most maxBatchUpdates)
+// goes in a single CodeUpdateBatch message. A single update is still sent with CodeUpdate.
+// The receiver decodes every update of a batch and checks it against its record before applying any: a malformed batch,
+// or one with an update that can't be applied(a write of a missing file...), changes nothing and only that update is
+// refused, the sender sends the others again. The updates are then applied in order under one lock, so no other update
+// is applied in the middle of a batch. A failure that only shows while applying(the disk) does not undo the updates
+// before it, the batch is then answered with the status of the failed update.
+//
+// CodeRegister and CodeDrop carry only the node added or removed, like the state store journal, instead of the whole
+// list of online nodes. CodeNodes still carries the whole list.
+
+const (
+	defaultBatchWindow = 5 * time.Millisecond
+	maxBatchUpdates    = 256
+)
+
+// nodesDelta is the update telling other nodes that n joined(CodeRegister) or left(CodeDrop) the mesh
+func nodesDelta(code Code, by string, n Node) UpdateTime {
+	if code == CodeDrop {
+		n = Node{Oauth: n.Oauth}
+	}
+	content, _ := json.Marshal(&n)
+	return updateTimeNow(code, by, string(content))
+}
+
+// sendUpdateBatch returns an error if _node could not be reached, otherwise the status of each update in order.
+// An update without status was not applied and must be sent again, no status at all means every update was delivered.
+// Refused updates are only logged
+func sendUpdateBatch(node *NodeConfig, _node Node, updates []UpdateTime) ([]ResponseStatus, error) {
+	if len(updates) == 1 {
+		return nil, sendUpdate(node, _node, &updates[0])
+	}
+	batchRaw, _ := json.Marshal(updates)
+	mssg := Message{
+		Header: MessageHeader{
+			Node:        node.Node,
+			Destination: _node.Oauth.UserName,
+		},
+		Body: MessageBody{
+			Code:    CodeUpdateBatch,
+			Content: string(batchRaw),
+		},
+	}
+	resMssg, err := node.send(context.Background(), _node.Address, &mssg)
+	if err != nil {
+		return nil, err
+	}
+
+	if resMssg.Body.Status != StatusOk {
+		log.Printf("Node(%s) update batch of %d responded with %q\n", _node.Oauth.UserName, len(updates), resMssg.Body.Status)
+	}
+	var statuses []ResponseStatus
+	if json.Unmarshal([]byte(resMssg.Body.Content), &statuses) != nil || len(statuses) != len(updates) {
+		// nothing tells which update was applied, sending them again would not help
+		return nil, nil
+	}
+	answered := false
+	for i, status := range statuses {
+		if status != StatusOk && status != "" {
+			log.Printf("Node(%s) update code(%s) responded with %q\n", _node.Oauth.UserName, updates[i].Code, status)
+		}
+		answered = answered || status != ""
+	}
+	if !answered {
+		return nil, nil
+	}
+	return statuses, nil
+}
+
+// HandleCodeUpdateBatch checks the whole batch against the record before applying any update, the status of each update
+// is returned in order. A refused batch only has the status of the refused update, see sendUpdateBatch.
+// Only a storage error while applying can stop a checked batch: the updates after it are not applied(status "")
+func (node *NodeConfig) HandleCodeUpdateBatch(mssg *Message) *Message {
+	var updates []UpdateTime
+	if err := json.Unmarshal([]byte(mssg.Body.Content), &updates); err != nil {
+		log.Printf("(HandleCodeUpdateBatch) unmarshalling UpdateTime failed%q\n", err)
+		return responseFormat(node, mssg, StatusBadFormat, true, err.Error())
+	}
+	statuses := make([]ResponseStatus, len(updates))
+	refuse := func(i int, status ResponseStatus) *Message {
+		statuses[i] = status
+		resBody, _ := json.Marshal(statuses)
+		return responseFormat(node, mssg, status, true, string(resBody))
+	}
+
+	batch := make([]pendingUpdate, 0, len(updates))
+	for i, u := range updates {
+		pending, status, _ := decodeUpdate(mssg.Header.Node.Oauth.UserName, u)
+		if status != StatusOk {
+			return refuse(i, status)
+		}
+		batch = append(batch, pending)
+	}
+
+	node.updateMx.Lock()
+	defer node.updateMx.Unlock()
+	if i, status := checkBatch(node, batch); status != StatusOk {
+		return refuse(i, status)
+	}
+	batchStatus := StatusOk
+	for i, pending := range batch {
+		statuses[i], _ = node.applyUpdate(pending)
+		if !updateApplied(statuses[i]) {
+			// the sender sends the rest again
+			batchStatus = statuses[i]
+			break
+		}
+	}
+	resBody, _ := json.Marshal(statuses)
+	return responseFormat(node, mssg, batchStatus, true, string(resBody))
+}
+
+// updateApplied reports whether an update answered with status left the record as the sender expects it
+func updateApplied(status ResponseStatus) bool {
+	// the record already had a newer version, or kept both
+	return status == StatusOk || status == StatusFileUpdateOld || status == StatusFileConflict
+}
+
+// checkBatch finds the first update of batch that can't be applied to the record after the updates before it,
+// node.updateMx must be held. The files moved by a rename are followed
+func checkBatch(node *NodeConfig, batch []pendingUpdate) (int, ResponseStatus) {
+	// names created(true) or deleted(false) by the updates checked so far, and whether they are directories
+	changed := map[FileName]bool{}
+	dirs := map[FileName]bool{}
+	exists := func(name FileName) bool {
+		if ok, seen := changed[name]; seen {
+			return ok
+		}
+		_, ok := node.getFile(string(name))
+		return ok
+	}
+	isDir := func(name FileName) bool {
+		if _, seen := changed[name]; seen {
+			return dirs[name]
+		}
+		f, _ := node.getFile(string(name))
+		return f.IsDir
+	}
+	// moves from and everything under it to to
+	rename := func(from, to FileName) {
+		under := func(name FileName) bool {
+			return name == from || strings.HasPrefix(string(name), string(from)+"/")
+		}
+		moved := []FileName{}
+		for name, ok := range changed {
+			if ok && under(name) {
+				moved = append(moved, name)
+			}
+		}
+		node.dirsRwMx.RLock()
+		for name := range node.Record.Directory.FilesList {
+			if _, seen := changed[FileName(name)]; !seen && under(FileName(name)) {
+				moved = append(moved, FileName(name))
+			}
+		}
+		node.dirsRwMx.RUnlock()
+
+		movedDirs := make([]bool, len(moved))
+		for i, name := range moved {
+			movedDirs[i] = isDir(name)
+			changed[name] = false
+		}
+		for i, name := range moved {
+			newName := to + name[len(from):]
+			changed[newName] = true
+			dirs[newName] = movedDirs[i]
+		}
+	}
+
+	for i, pending := range batch {
+		switch pending.Code {
+		case CodeCreateFile, CodeCreateDir:
+			changed[pending.name] = true
+			dirs[pending.name] = pending.Code == CodeCreateDir
+
+		case CodeUpdateFile, CodeDeleteFile, CodeDeleteDir:
+			if !exists(pending.name) {
+				return i, StatusFileNotFound
+			}
+			if pending.Code != CodeUpdateFile {
+				changed[pending.name] = false
+			}
+
+		case CodeRenameDir:
+			from, to := pending.name, pending.to
+			if to == from || strings.HasPrefix(string(to), string(from)+"/") {
+				return i, StatusBadFileName
+			}
+			if ok, seen := changed[from]; from == "" || seen && !(ok && dirs[from]) || !seen && !node.dirExists(from) {
+				return i, StatusDirNotFound
+			}
+			if exists(to) {
+				return i, StatusFileExist
+			}
+			rename(from, to)
+		}
+	}
+	return -1, StatusOk
+}
@@ -0,0 +1,39 @@
+package node
+
+import "testing"
+
+func TestCheckBatch(t *testing.T) {
+	n := newStreamTestNode(t, nil)
+	if m := n.ClientCreateDir("a"); m.Status != StatusOk {
+		t.Fatal(m.Status)
+	}
+	if m := n.ClientCreateFile("a/x"); m.Status != StatusOk {
+		t.Fatal(m.Status)
+	}
+
+	update := func(code Code, name FileName) pendingUpdate {
+		return pendingUpdate{UpdateTime: UpdateTime{Code: code}, name: name}
+	}
+	rename := func(from, to FileName) pendingUpdate {
+		return pendingUpdate{UpdateTime: UpdateTime{Code: CodeRenameDir}, name: from, to: to}
+	}
+	tests := []struct {
+		name   string
+		batch  []pendingUpdate
+		index  int
+		status ResponseStatus
+	}{
+		{"write after a rename", []pendingUpdate{rename("a", "b"), update(CodeUpdateFile, "b/x")}, -1, StatusOk},
+		{"write of a moved name", []pendingUpdate{rename("a", "b"), update(CodeUpdateFile, "a/x")}, 1, StatusFileNotFound},
+		{"rename of a moved directory", []pendingUpdate{rename("a", "b"), rename("b", "c"), update(CodeDeleteFile, "c/x")}, -1, StatusOk},
+		{"rename of a moved directory into itself", []pendingUpdate{rename("a", "b"), rename("b", "b/y")}, 1, StatusBadFileName},
+		{"rename onto a new name", []pendingUpdate{update(CodeCreateFile, "d"), rename("a", "d")}, 1, StatusFileExist},
+		{"created directory moved", []pendingUpdate{update(CodeCreateDir, "e"), update(CodeCreateFile, "e/f"), rename("e", "g"), update(CodeDeleteFile, "g/f"), update(CodeDeleteDir, "e")}, 4, StatusFileNotFound},
+		{"rename of a moved file", []pendingUpdate{rename("a", "b"), rename("b/x", "z")}, 1, StatusDirNotFound},
+	}
+	for _, tt := range tests {
+		if i, status := checkBatch(n, tt.batch); i != tt.index || status != tt.status {
+			t.Errorf("%s: got %q at %d, want %q at %d", tt.name, status, i, tt.status, tt.index)
+		}
+	}
+}
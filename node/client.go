@@ -1,6 +1,7 @@
 package node
 
 import (
+	"context"
 	"encoding/json"
 	"log"
 )
@@ -8,26 +9,50 @@ import (
 // METHOD IN THIS FILE HANDLE REQUESTS OF THE CLIENT
 
 func (node *NodeConfig) ClientCreateFile(fileName string) *MessageBody {
-	if f, ok := node.getFile(fileName); ok {
+	name, err := ParseFileName(fileName)
+	if err != nil {
+		return messageBodyFormat(CodeCreateFile, StatusBadFileName, fileName)
+	}
+	node.writeMx.Lock()
+	defer node.writeMx.Unlock()
+	// a file created now would not be handed over
+	if node.isDraining() {
+		return messageBodyFormat(CodeCreateFile, StatusNodeDraining, node.Node.Oauth.UserName)
+	}
+	if f, ok := node.getFile(string(name)); ok {
 		return messageBodyFormat(CodeCreateFile, StatusFileExist, f.Owner)
 	}
+	if !node.dirExists(parentDir(name)) {
+		return messageBodyFormat(CodeCreateFile, StatusDirNotFound, string(parentDir(name)))
+	}
 
-	err := createFile(node, fileName)
+	err = createFile(node, name)
 	if err != nil {
 		log.Printf("ClientCreateFile writeFile %q\n", err)
 		return messageBodyFormat(CodeCreateFile, StatusInternalError, err.Error())
 	}
 
-	f := clientMakeCUD(node, File{Name: fileName}, updateTimeNow(CodeCreateFile, node.Node.Oauth.UserName, ""))
+	f := fileMetadata(node, File{Name: string(name)})
+	f = clientMakeCUD(node, f, updateTimeNow(CodeCreateFile, node.Node.Oauth.UserName, ""))
 	node.createFile(f)
-	return messageBodyFormat(CodeCreateFile, StatusOk, fileName)
+	node.queueReplication(f.Name)
+	return messageBodyFormat(CodeCreateFile, StatusOk, string(name))
 }
 
-func (node *NodeConfig) ClientUpdateFile(updateFileContent UpdateFileContent) *MessageBody {
+// ClientUpdateFile writes a file through its owner, the write is abandoned if ctx is done before the owner answers
+func (node *NodeConfig) ClientUpdateFile(ctx context.Context, updateFileContent UpdateFileContent) *MessageBody {
+	name, err := ParseFileName(updateFileContent.Name)
+	if err != nil {
+		return messageBodyFormat(CodeUpdateFile, StatusBadFileName, updateFileContent.Name)
+	}
+	updateFileContent.Name = string(name)
 	f, ok := node.getFile(updateFileContent.Name)
 	if !ok {
 		return messageBodyFormat(CodeUpdateFile, StatusFileNotFound, updateFileContent.Name)
 	}
+	if f.IsDir {
+		return messageBodyFormat(CodeUpdateFile, StatusIsDir, updateFileContent.Name)
+	}
 
 	remoteNode, ok := node.getNode(f.Owner)
 	if !ok {
@@ -47,7 +72,7 @@ func (node *NodeConfig) ClientUpdateFile(updateFileContent UpdateFileContent) *M
 		return &node.HandleCodeUpdateFile(&reqMssg).Body
 	}
 
-	resMssg, err := node.NetClient(remoteNode.Address, &reqMssg)
+	resMssg, err := node.send(ctx, remoteNode.Address, &reqMssg)
 	if err != nil {
 		log.Printf("ClientUpdateFile network error: %q\n", err)
 		return messageBodyFormat(CodeUpdateFile, StatusInternalError, err.Error())
@@ -55,68 +80,127 @@ func (node *NodeConfig) ClientUpdateFile(updateFileContent UpdateFileContent) *M
 	return &resMssg.Body
 }
 
-func (node *NodeConfig) ClientReadFile(fileName string) *MessageBody {
+// ClientReadFile returns the content of fileName encoded with encoding, see EncodingBase64.
+// Holders of the file are not asked anymore once ctx is done
+func (node *NodeConfig) ClientReadFile(ctx context.Context, fileName, encoding string) *MessageBody {
+	return node.clientReadFile(ctx, CodeInfoContent{Content: fileName, Encoding: encoding})
+}
+
+// ClientReadFileRange reads length bytes of fileName at offset(up to the end if length is 0), a negative offset
+// reads the last -offset bytes. The content of the response is a CodeInfoContent with the range read and the size of the file
+func (node *NodeConfig) ClientReadFileRange(ctx context.Context, fileName, encoding string, offset, length int64) *MessageBody {
+	return node.clientReadFile(ctx, CodeInfoContent{Content: fileName, Encoding: encoding, Offset: offset, Length: length})
+}
+
+func (node *NodeConfig) clientReadFile(ctx context.Context, getFile CodeInfoContent) *MessageBody {
+	fileName := getFile.Content
+	name, err := ParseFileName(fileName)
+	if err != nil {
+		return messageBodyFormat(CodeReadFile, StatusBadFileName, fileName)
+	}
+	fileName = string(name)
 	f, ok := node.getFile(fileName)
 	if !ok {
 		return messageBodyFormat(CodeReadFile, StatusFileNotFound, fileName)
 	}
-
-	remoteNode, ok := node.getNode(f.Owner)
-	if !ok {
-		return messageBodyFormat(CodeReadFile, StatusNodeNotOnline, f.Owner)
+	if f.IsDir {
+		return messageBodyFormat(CodeReadFile, StatusIsDir, fileName)
 	}
 
-	getFileRaw, _ := json.Marshal(CodeInfoContent{
-		Code:    CodeReadFile,
-		Content: fileName,
-	})
-	reqMssg := Message{
-		Header: MessageHeader{
-			Node:        node.Node,
-			Destination: f.Owner,
-		},
-		Body: *messageBodyFormat(CodeGetInfo, "", string(getFileRaw)),
+	targets := node.readTargets(f)
+	if len(targets) == 0 {
+		return messageBodyFormat(CodeReadFile, StatusNodeNotOnline, f.Owner)
 	}
 
-	if f.Owner == node.Node.Oauth.UserName {
-		return &node.HandleCodeGetInfo(&reqMssg).Body
-	}
+	getFile.Code, getFile.Content = CodeReadFile, fileName
+	getFileRaw, _ := json.Marshal(&getFile)
+	res := messageBodyFormat(CodeReadFile, StatusNodeNotOnline, f.Owner)
+	var mismatch *MessageBody
+	// the owner first, then the replicas
+	for _, target := range targets {
+		reqMssg := Message{
+			Header: MessageHeader{
+				Node:        node.Node,
+				Destination: target.Oauth.UserName,
+			},
+			Body: *messageBodyFormat(CodeGetInfo, "", string(getFileRaw)),
+		}
+
+		if target.Oauth.UserName == node.Node.Oauth.UserName {
+			res = &node.HandleCodeGetInfo(&reqMssg).Body
+		} else if resMssg, err := node.send(ctx, target.Address, &reqMssg); err != nil {
+			log.Printf("ClientReadFile network error: %q\n", err)
+			res = messageBodyFormat(CodeReadFile, StatusInternalError, err.Error())
+		} else {
+			res = &resMssg.Body
+		}
+		if res.Status == StatusOk && getFile.Offset == 0 && getFile.Length == 0 && !node.contentMatches(f, getFile.Encoding, res.Content) {
+			// maybe a stale replica, try the next holder
+			log.Printf("ClientReadFile content of %q from node(%s) doesn't match its checksum\n", fileName, target.Oauth.UserName)
+			res = messageBodyFormat(CodeReadFile, StatusChecksumMismatch, target.Oauth.UserName)
+			mismatch = res
+		}
+		if res.Status == StatusOk || ctx.Err() != nil {
+			return res
+		}
+	}
+	if mismatch != nil {
+		return mismatch
+	}
+	return res
+}
 
-	resMssg, err := node.NetClient(remoteNode.Address, &reqMssg)
+// contentMatches verifies content read for f, against the latest version known too since it may have changed while it was read
+func (node *NodeConfig) contentMatches(f File, encoding, content string) bool {
+	data, err := decodeContent(encoding, content)
 	if err != nil {
-		log.Printf("ClientReadFile network error: %q\n", err)
-		return messageBodyFormat(CodeUpdateFile, StatusInternalError, err.Error())
+		return false
 	}
-
-	return &resMssg.Body
+	if checksumMatches(f, data) {
+		return true
+	}
+	latest, ok := node.getFile(f.Name)
+	return ok && latest.SHA256 != f.SHA256 && checksumMatches(latest, data)
 }
 
-func (node *NodeConfig) ClientDeleteFile(fileName string) *MessageBody {
+// ClientDeleteFile deletes the file deleteFileContent.Name, the owner checks IfMatch and IfNoneMatch first
+func (node *NodeConfig) ClientDeleteFile(ctx context.Context, deleteFileContent UpdateFileContent) *MessageBody {
+	fileName := deleteFileContent.Name
+	name, err := ParseFileName(fileName)
+	if err != nil {
+		return messageBodyFormat(CodeDeleteFile, StatusBadFileName, fileName)
+	}
+	fileName = string(name)
+	deleteFileContent.Name = fileName
 	f, ok := node.getFile(fileName)
 	if !ok {
 		return messageBodyFormat(CodeDeleteFile, StatusFileNotFound, fileName)
 	}
+	if f.IsDir {
+		return messageBodyFormat(CodeDeleteFile, StatusIsDir, fileName)
+	}
 
 	remoteNode, ok := node.getNode(f.Owner)
 	if !ok {
 		return messageBodyFormat(CodeDeleteFile, StatusNodeNotOnline, f.Owner)
 	}
 
+	deleteFileRaw, _ := json.Marshal(&deleteFileContent)
 	reqMssg := Message{
 		Header: MessageHeader{
 			Node:        node.Node,
 			Destination: f.Owner,
 		},
-		Body: *messageBodyFormat(CodeDeleteFile, "", string(fileName)),
+		Body: *messageBodyFormat(CodeDeleteFile, "", string(deleteFileRaw)),
 	}
 
 	if remoteNode.Oauth.UserName == node.Node.Oauth.UserName {
 		return &node.HandleCodeDeleteFile(&reqMssg).Body
 	}
 
-	resMssg, err := node.NetClient(remoteNode.Address, &reqMssg)
+	resMssg, err := node.send(ctx, remoteNode.Address, &reqMssg)
 	if err != nil {
-		log.Printf("ClientReadFile network error: %q\n", err)
+		log.Printf("ClientDeleteFile network error: %q\n", err)
 		return messageBodyFormat(CodeResponse, StatusInternalError, err.Error())
 	}
 
@@ -124,19 +208,12 @@ func (node *NodeConfig) ClientDeleteFile(fileName string) *MessageBody {
 }
 
 func (node *NodeConfig) ClientRecord() *MessageBody {
-	recJson, _ := node.marshalJSONRecord()
-	resBody, _ := json.Marshal(nodesClearPasswordRecordJson(string(recJson)))
-	return messageBodyFormat(CodeNone, StatusOk, string(resBody))
-}
-
-func (node *NodeConfig) ClientDir() *MessageBody {
-	resBody, _ := node.marshalJSONDirectory()
+	resBody, _ := node.marshalJSONRecord()
 	return messageBodyFormat(CodeNone, StatusOk, string(resBody))
 }
 
 func (node *NodeConfig) ClientNodes() *MessageBody {
-	nodesJson, _ := node.marshalJSONNodes()
-	resBody, _ := json.Marshal(nodesClearPasswordJson(string(nodesJson)))
+	resBody, _ := node.marshalJSONNodes()
 	return messageBodyFormat(CodeNone, StatusOk, string(resBody))
 }
 
@@ -146,32 +223,17 @@ func (node *NodeConfig) ClientWebDir(mssg *Message) *Message {
 
 func clientMakeCUD(node *NodeConfig, file File, update UpdateTime) File {
 	update.Content = ""
+	update.Clock = node.tick()
 	file.RecentUpdate = update
-	if update.Code == CodeCreateFile {
+	file.Versions = bumpVersion(file.Versions, node.Node.Oauth.UserName)
+	if update.Code == CodeCreateFile || update.Code == CodeCreateDir {
 		file.CreatedAt = update.At
 		file.Owner = update.By
+		file.Creator = update.By
 	}
 
 	fileJson, _ := json.Marshal(&file)
 	update.Content = string(fileJson)
-	node.updatesChan <- &update
+	node.queueUpdate(update)
 	return file
 }
-
-func nodesClearPasswordJson(nodesRaw string) OnlineNodes {
-	var nodes OnlineNodes
-	json.Unmarshal([]byte(nodesRaw), &nodes)
-	for k, v := range nodes.NodesList {
-		v.Oauth.Password = "******"
-		nodes.NodesList[k] = v
-	}
-	return nodes
-}
-
-func nodesClearPasswordRecordJson(recordRaw string) Record {
-	var record Record
-	json.Unmarshal([]byte(recordRaw), &record)
-	nodesRaw, _ := json.Marshal(record.OnlineNodes)
-	record.OnlineNodes = nodesClearPasswordJson(string(nodesRaw))
-	return record
-}
@@ -0,0 +1,214 @@
+package node
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ORDERING UPDATES WITHOUT TRUSTING WALL CLOCKS
+//
+// Every file carries a version vector: the number of changes each node made to it. A node bumps its own entry
+// when it publishes a change, so a version that saw another one dominates it. Versions where neither dominates
+// were made concurrently, they are recorded as a conflict instead of being silently dropped.
+// Files with a different created_at are different incarnations of a name, they are concurrent too.
+//
+// To still agree on what to keep, every change is stamped with a hybrid logical clock(HLC): the physical time
+// corrected by the clocks seen in updates from other nodes, so causally later changes get later clocks even under skew.
+
+// a remote clock further ahead than this is not followed
+const maxClockDrift = time.Minute
+
+// HLC is a hybrid logical clock, Node breaks ties so two clocks are never equal
+type HLC struct {
+	Wall    int64  `json:"wall"`
+	Logical uint32 `json:"logical"`
+	Node    string `json:"node"`
+}
+
+func (c HLC) After(o HLC) bool {
+	if c.Wall != o.Wall {
+		return c.Wall > o.Wall
+	}
+	if c.Logical != o.Logical {
+		return c.Logical > o.Logical
+	}
+	return c.Node > o.Node
+}
+
+// Conflict is a concurrent version of a file that was not kept
+type Conflict struct {
+	Name       string    `json:"name"`
+	Kept       File      `json:"kept"`
+	Lost       File      `json:"lost"`
+	DetectedAt time.Time `json:"detected_at"`
+}
+
+type hybridClock struct {
+	mx   sync.Mutex
+	last HLC
+}
+
+// tick returns the clock of a new local event
+func (node *NodeConfig) tick() HLC {
+	node.clock.mx.Lock()
+	defer node.clock.mx.Unlock()
+	now := time.Now().UnixNano()
+	if now > node.clock.last.Wall {
+		node.clock.last = HLC{Wall: now}
+	} else {
+		node.clock.last.Logical++
+	}
+	node.clock.last.Node = node.Node.Oauth.UserName
+	return node.clock.last
+}
+
+// observe moves the clock past a clock received from another node
+func (node *NodeConfig) observe(remote HLC) {
+	now := time.Now().UnixNano()
+	if remote.Wall-now > int64(maxClockDrift) {
+		log.Printf("(observe) clock of node(%s) is %s ahead, ignoring it\n", remote.Node, time.Duration(remote.Wall-now))
+		return
+	}
+	node.clock.mx.Lock()
+	defer node.clock.mx.Unlock()
+	last := node.clock.last
+	switch {
+	case now > last.Wall && now > remote.Wall:
+		node.clock.last = HLC{Wall: now}
+	case last.Wall == remote.Wall:
+		node.clock.last.Logical = maxLogical(last.Logical, remote.Logical) + 1
+	case last.Wall > remote.Wall:
+		node.clock.last.Logical++
+	default:
+		node.clock.last = HLC{Wall: remote.Wall, Logical: remote.Logical + 1}
+	}
+}
+
+func maxLogical(a, b uint32) uint32 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+type versionOrder int
+
+const (
+	versionEqual versionOrder = iota
+	versionBefore
+	versionAfter
+	versionConcurrent
+)
+
+// compareVersions orders a relatively to b
+func compareVersions(a, b File) versionOrder {
+	if !a.CreatedAt.Equal(b.CreatedAt) || a.Creator != b.Creator {
+		return versionConcurrent
+	}
+	less, more := false, false
+	for n, v := range a.Versions {
+		if v > b.Versions[n] {
+			more = true
+		}
+	}
+	for n, v := range b.Versions {
+		if v > a.Versions[n] {
+			less = true
+		}
+	}
+	switch {
+	case less && more:
+		return versionConcurrent
+	case more:
+		return versionAfter
+	case less:
+		return versionBefore
+	}
+	return versionEqual
+}
+
+func bumpVersion(versions map[string]uint64, nodeName string) map[string]uint64 {
+	bumped := map[string]uint64{}
+	for n, v := range versions {
+		bumped[n] = v
+	}
+	bumped[nodeName]++
+	return bumped
+}
+
+func mergeVersions(a, b map[string]uint64) map[string]uint64 {
+	merged := map[string]uint64{}
+	for n, v := range a {
+		merged[n] = v
+	}
+	for n, v := range b {
+		if v > merged[n] {
+			merged[n] = v
+		}
+	}
+	return merged
+}
+
+// resolveFile decides between the local and a remote version of a file. It returns the version to keep,
+// whether it is the remote one and the status to answer to the sender
+func (node *NodeConfig) resolveFile(local, remote File) (File, bool, ResponseStatus) {
+	switch compareVersions(remote, local) {
+	case versionAfter:
+		node.clearConflict(remote.Name)
+		return remote, true, StatusOk
+	case versionEqual, versionBefore:
+		return local, false, StatusFileUpdateOld
+	}
+
+	// both nodes keep the version with the later clock, and the merged vector so the next change dominates both
+	kept, lost := local, remote
+	if remote.RecentUpdate.Clock.After(local.RecentUpdate.Clock) {
+		kept, lost = remote, local
+	}
+	if kept.CreatedAt.Equal(lost.CreatedAt) {
+		kept.Versions = mergeVersions(kept.Versions, lost.Versions)
+	}
+	log.Printf("Concurrent versions of %q, keeping the one of node(%s)\n", remote.Name, kept.RecentUpdate.By)
+	node.recordConflict(Conflict{Name: remote.Name, Kept: kept, Lost: lost, DetectedAt: time.Now()})
+	return kept, kept.RecentUpdate.Clock == remote.RecentUpdate.Clock, StatusFileConflict
+}
+
+func (node *NodeConfig) recordConflict(c Conflict) {
+	node.conflictsMx.Lock()
+	defer node.conflictsMx.Unlock()
+	node.conflicts[c.Name] = c
+}
+
+func (node *NodeConfig) clearConflict(fileName string) {
+	node.conflictsMx.Lock()
+	defer node.conflictsMx.Unlock()
+	delete(node.conflicts, fileName)
+}
+
+// ClientConflicts returns the concurrent versions detected by this node, a later change of the file clears them
+func (node *NodeConfig) ClientConflicts() *MessageBody {
+	node.conflictsMx.Lock()
+	conflicts := make([]Conflict, 0, len(node.conflicts))
+	for _, c := range node.conflicts {
+		conflicts = append(conflicts, c)
+	}
+	node.conflictsMx.Unlock()
+
+	sort.Slice(conflicts, func(i, j int) bool { return conflicts[i].Name < conflicts[j].Name })
+	resBody, _ := json.Marshal(conflicts)
+	return messageBodyFormat(CodeNone, StatusOk, string(resBody))
+}
+
+// ClientResolveConflict acknowledges the conflict of fileName, the kept version stays
+func (node *NodeConfig) ClientResolveConflict(fileName string) *MessageBody {
+	node.conflictsMx.Lock()
+	defer node.conflictsMx.Unlock()
+	if _, ok := node.conflicts[fileName]; !ok {
+		return messageBodyFormat(CodeNone, StatusFileNotFound, fileName)
+	}
+	delete(node.conflicts, fileName)
+	return messageBodyFormat(CodeNone, StatusOk, fileName)
+}
@@ -0,0 +1,173 @@
+package node
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"strings"
+)
+
+// DIRECTORIES ARE ENTRIES OF Directory.FilesList WITH IsDir SET, NAMES ARE SLASH-SEPARATED PATHS
+//
+// A directory is virtual, files inside it may be owned by different nodes. Every node keeps the part
+// of the tree it owns under BaseFilePath, so directory operations are applied by all nodes.
+
+// DirTree is the tree-shaped view of the directory
+type DirTree struct {
+	File
+	Children []DirTree `json:"children,omitempty"`
+}
+
+// used internally
+type RenameDirContent struct {
+	Name    string `json:"name"`
+	NewName string `json:"new_name"`
+}
+
+func (node *NodeConfig) ClientCreateDir(dirName string) *MessageBody {
+	name, err := ParseFileName(dirName)
+	if err != nil {
+		return messageBodyFormat(CodeCreateDir, StatusBadFileName, dirName)
+	}
+	node.writeMx.Lock()
+	defer node.writeMx.Unlock()
+	if node.isDraining() {
+		return messageBodyFormat(CodeCreateDir, StatusNodeDraining, node.Node.Oauth.UserName)
+	}
+	if f, ok := node.getFile(string(name)); ok {
+		return messageBodyFormat(CodeCreateDir, StatusFileExist, f.Owner)
+	}
+	if !node.dirExists(parentDir(name)) {
+		return messageBodyFormat(CodeCreateDir, StatusDirNotFound, string(parentDir(name)))
+	}
+
+	if err := createDir(node, name); err != nil {
+		log.Printf("ClientCreateDir createDir %q\n", err)
+		return messageBodyFormat(CodeCreateDir, StatusInternalError, err.Error())
+	}
+
+	f := clientMakeCUD(node, File{Name: string(name), IsDir: true}, updateTimeNow(CodeCreateDir, node.Node.Oauth.UserName, ""))
+	node.createFile(f)
+	return messageBodyFormat(CodeCreateDir, StatusOk, string(name))
+}
+
+func (node *NodeConfig) ClientRenameDir(dirName, newName string) *MessageBody {
+	from, err := ParseFileName(dirName)
+	if err != nil {
+		return messageBodyFormat(CodeRenameDir, StatusBadFileName, dirName)
+	}
+	to, err := ParseFileName(newName)
+	if err != nil {
+		return messageBodyFormat(CodeRenameDir, StatusBadFileName, newName)
+	}
+	if !node.dirExists(parentDir(to)) {
+		return messageBodyFormat(CodeRenameDir, StatusDirNotFound, string(parentDir(to)))
+	}
+
+	updates := updateTimeNow(CodeRenameDir, node.Node.Oauth.UserName, "")
+	updates.Clock = node.tick()
+	if status := applyRenameDir(node, from, to, updates); status != StatusOk {
+		return messageBodyFormat(CodeRenameDir, status, string(from))
+	}
+
+	renameJson, _ := json.Marshal(&RenameDirContent{Name: string(from), NewName: string(to)})
+	updates.Content = string(renameJson)
+	node.queueUpdate(updates)
+	return messageBodyFormat(CodeRenameDir, StatusOk, string(to))
+}
+
+func (node *NodeConfig) ClientDeleteDir(dirName string) *MessageBody {
+	name, err := ParseFileName(dirName)
+	if err != nil {
+		return messageBodyFormat(CodeDeleteDir, StatusBadFileName, dirName)
+	}
+	f, ok := node.getFile(string(name))
+	if !ok || !f.IsDir {
+		return messageBodyFormat(CodeDeleteDir, StatusDirNotFound, dirName)
+	}
+	if len(node.dirTree(name).Children) > 0 {
+		return messageBodyFormat(CodeDeleteDir, StatusDirNotEmpty, dirName)
+	}
+
+	if err := deleteDir(node, name); err != nil {
+		log.Printf("ClientDeleteDir deleteDir %q\n", err)
+		return messageBodyFormat(CodeDeleteDir, StatusInternalError, err.Error())
+	}
+
+	updates := updateTimeNow(CodeDeleteDir, node.Node.Oauth.UserName, "")
+	clientMakeCUD(node, f, updates)
+	node.deleteFile(f.Name, updates)
+	return messageBodyFormat(CodeDeleteDir, StatusOk, dirName)
+}
+
+// ClientDir returns the tree of dirName, the whole directory if it is empty
+func (node *NodeConfig) ClientDir(dirName string) *MessageBody {
+	name, err := parseDirName(dirName)
+	if err != nil {
+		return messageBodyFormat(CodeDirectory, StatusBadFileName, dirName)
+	}
+	if !node.dirExists(name) {
+		return messageBodyFormat(CodeDirectory, StatusDirNotFound, dirName)
+	}
+	resBody, _ := json.Marshal(node.dirTree(name))
+	return messageBodyFormat(CodeNone, StatusOk, string(resBody))
+}
+
+func (node *NodeConfig) dirExists(dirName FileName) bool {
+	if dirName == "" {
+		return true
+	}
+	f, ok := node.getFile(string(dirName))
+	return ok && f.IsDir
+}
+
+func (node *NodeConfig) dirTree(dirName FileName) DirTree {
+	node.dirsRwMx.RLock()
+	children := map[string][]File{}
+	for _, f := range node.Record.Directory.FilesList {
+		if f.Name == string(dirName) || (dirName != "" && !strings.HasPrefix(f.Name, string(dirName)+"/")) {
+			continue
+		}
+		parent := string(parentDir(FileName(f.Name)))
+		children[parent] = append(children[parent], f)
+	}
+	root, ok := node.Record.Directory.FilesList[string(dirName)]
+	node.dirsRwMx.RUnlock()
+	if !ok {
+		root = File{Name: string(dirName), IsDir: true}
+	}
+
+	var build func(f File) DirTree
+	build = func(f File) DirTree {
+		tree := DirTree{File: f}
+		files := children[f.Name]
+		sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+		for _, child := range files {
+			tree.Children = append(tree.Children, build(child))
+		}
+		return tree
+	}
+	return build(root)
+}
+
+// applyRenameDir moves dirName and everything under it to newName, in the record and in the owned part on disk
+func applyRenameDir(node *NodeConfig, dirName, newName FileName, updates UpdateTime) ResponseStatus {
+	// the watcher must not see the files moved on disk before the record
+	node.writeMx.Lock()
+	defer node.writeMx.Unlock()
+	if newName == dirName || strings.HasPrefix(string(newName), string(dirName)+"/") {
+		return StatusBadFileName
+	}
+	if !node.dirExists(dirName) || dirName == "" {
+		return StatusDirNotFound
+	}
+	if _, ok := node.getFile(string(newName)); ok {
+		return StatusFileExist
+	}
+	if err := renameDir(node, dirName, newName); err != nil {
+		log.Printf("(applyRenameDir) renaming %q to %q failed: %q\n", dirName, newName, err)
+		return StatusInternalError
+	}
+	node.renameDir(string(dirName), string(newName), updates)
+	return StatusOk
+}
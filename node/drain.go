@@ -0,0 +1,335 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A DRAINED NODE LEAVES THE MESH WITHOUT TAKING ITS FILES WITH IT
+//
+// Every owned file(directories first) is sent to a peer with CodeTransferFile(through StreamClient), the peer copies
+// the content, becomes the owner and publishes the change with CodeUpdateFile. Replica holders are preferred.
+// The saved versions of a file are sent first with CodeTransferVersion, the history follows the file.
+// The local copy of a transferred file is removed. Once nothing is owned anymore the node publishes CodeDrop for itself
+// and stops. Creations and writes are refused while draining.
+
+// ClientDrain hands the owned files over to other nodes, drops this node from the mesh and stops it.
+// The content of the response maps file names to their new owners, or lists the files that could not be transferred
+func (node *NodeConfig) ClientDrain() *MessageBody {
+	if !node.beginDrain() {
+		return messageBodyFormat(CodeTransferFile, StatusNodeDraining, node.Node.Oauth.UserName)
+	}
+	log.Printf("Node(%s) is draining\n", node.Node.Oauth.UserName)
+
+	files := ownedFiles(node)
+	// parents before their children
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	transferred := map[string]string{}
+	failed := []string{}
+	for _, f := range files {
+		if owner, ok := transferFile(node, f); ok {
+			transferred[f.Name] = owner
+		} else {
+			failed = append(failed, f.Name)
+		}
+	}
+	if len(failed) > 0 {
+		node.endDrain()
+		failedJson, _ := json.Marshal(failed)
+		return messageBodyFormat(CodeTransferFile, StatusInternalError, string(failedJson))
+	}
+
+	// the local copies of the directories are empty now, children first
+	for i := len(files) - 1; i >= 0; i-- {
+		if files[i].IsDir {
+			if err := deleteDir(node, FileName(files[i].Name)); err != nil {
+				log.Printf("(ClientDrain) removing the local copy of %q failed: %q\n", files[i].Name, err)
+			}
+		}
+	}
+	dropSelf(node)
+	node.Stop()
+	transferredJson, _ := json.Marshal(transferred)
+	return messageBodyFormat(CodeTransferFile, StatusOk, string(transferredJson))
+}
+
+// transferFile gives f to the first peer accepting it and returns the new owner
+func transferFile(node *NodeConfig, f File) (string, bool) {
+	candidates := []string{}
+	for _, r := range f.Replicas {
+		if _, ok := node.getNode(r); ok {
+			candidates = append(candidates, r)
+		}
+	}
+	for _, c := range replicaCandidates(node, f) {
+		if !containsName(candidates, c) {
+			candidates = append(candidates, c)
+		}
+	}
+
+	f.Replicas = nil
+	for _, candidate := range candidates {
+		n, ok := node.getNode(candidate)
+		if !ok {
+			continue
+		}
+		if err := transferVersions(node, n, f); err != nil {
+			log.Printf("(transferFile) sending the versions of %q to node(%s) failed: %q\n", f.Name, candidate, err)
+			continue
+		}
+		status, err := transferContent(node, n, f)
+		if status == StatusFileNotFound && err == nil && !f.IsDir {
+			// the content could not be read, no other node would get it either
+			return "", false
+		}
+		if err != nil {
+			log.Printf("(transferFile) dialing node(%s) error: %q\n", candidate, err)
+			continue
+		}
+		if status != StatusOk {
+			log.Printf("(transferFile) node(%s) responded with %q\n", candidate, status)
+			continue
+		}
+		deleteVersions(node, f)
+		if !f.IsDir {
+			// the new owner serves it now
+			if err := deleteFile(node, FileName(f.Name)); err != nil {
+				log.Printf("(transferFile) removing the local copy of %q failed: %q\n", f.Name, err)
+			}
+		}
+		log.Printf("File %q transferred to node(%s)\n", f.Name, candidate)
+		return candidate, true
+	}
+	return "", false
+}
+
+// transferContent sends f and its content to n with CodeTransferFile. The content is read again for every peer,
+// StatusFileNotFound is returned without error if it can't be
+func transferContent(node *NodeConfig, n Node, f File) (ResponseStatus, error) {
+	var body io.Reader
+	if !f.IsDir {
+		sf, status := node.openFile(f.Name)
+		if status != StatusOk {
+			log.Printf("(transferFile) opening %q failed with %q\n", f.Name, status)
+			return StatusFileNotFound, nil
+		}
+		file, err := sf.open(0, 0)
+		if err != nil {
+			log.Printf("(transferFile) reading %q failed: %q\n", f.Name, err)
+			return StatusFileNotFound, nil
+		}
+		defer file.Close()
+		body = file
+	}
+
+	fileRaw, _ := json.Marshal(&f)
+	mssg := Message{
+		Header: MessageHeader{
+			Node:        node.Node,
+			Destination: n.Oauth.UserName,
+		},
+		Body: *messageBodyFormat(CodeTransferFile, "", string(fileRaw)),
+	}
+	resMssg, resBody, err := node.sendStream(context.Background(), n.Address, &mssg, body)
+	if resBody != nil {
+		resBody.Close()
+	}
+	if err != nil {
+		return "", err
+	}
+	return resMssg.Body.Status, nil
+}
+
+// transferVersions sends the saved versions of f to n before f itself, the oldest first
+func transferVersions(node *NodeConfig, n Node, f File) error {
+	if f.IsDir {
+		return nil
+	}
+	dir := versionsDir(node, f)
+	for _, v := range savedVersions(node, f) {
+		rev := strconv.FormatUint(v.Revision, 10)
+		saved := f
+		if raw, err := os.ReadFile(filepath.Join(dir, rev+".json")); err == nil {
+			json.Unmarshal(raw, &saved)
+		}
+		// the current name, owner and identity of the file with the revision of the version
+		version := f
+		version.Revision, version.RecentUpdate = v.Revision, saved.RecentUpdate
+		version.Size, version.SHA256 = saved.Size, saved.SHA256
+
+		content, err := os.Open(filepath.Join(dir, rev))
+		if err != nil {
+			// removed since it was listed
+			continue
+		}
+		versionRaw, _ := json.Marshal(&version)
+		mssg := Message{
+			Header: MessageHeader{
+				Node:        node.Node,
+				Destination: n.Oauth.UserName,
+			},
+			Body: *messageBodyFormat(CodeTransferVersion, "", string(versionRaw)),
+		}
+		resMssg, resBody, err := node.sendStream(context.Background(), n.Address, &mssg, content)
+		content.Close()
+		if resBody != nil {
+			resBody.Close()
+		}
+		if err != nil {
+			return err
+		}
+		if resMssg.Body.Status != StatusOk {
+			return fmt.Errorf("revision %d refused with %q", v.Revision, resMssg.Body.Status)
+		}
+	}
+	return nil
+}
+
+// HandleCodeTransferVersion keeps a version of a file that the sender, its owner, is about to transfer to this node
+func (node *NodeConfig) HandleCodeTransferVersion(mssg *Message, body io.Reader) *Message {
+	var version File
+	if err := json.Unmarshal([]byte(mssg.Body.Content), &version); err != nil {
+		return responseFormat(node, mssg, StatusBadFormat, true, err.Error())
+	}
+	if name, err := ParseFileName(version.Name); err != nil || string(name) != version.Name {
+		return responseFormat(node, mssg, StatusBadFileName, true, version.Name)
+	}
+	if node.isDraining() {
+		return responseFormat(node, mssg, StatusNodeDraining, true, "")
+	}
+	// only the owner gives a file away, the history is kept by the identity of the file
+	f, ok := node.getFile(version.Name)
+	if !ok || f.IsDir || f.Owner != mssg.Header.Node.Oauth.UserName || fileKey(f) != fileKey(version) {
+		return responseFormat(node, mssg, StatusFileNotFound, true, version.Name)
+	}
+	if node.MaxVersions <= 0 {
+		// history is off here, the file is still taken
+		return responseFormat(node, mssg, StatusOk, true, "")
+	}
+
+	dir := versionsDir(node, f)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return responseFormat(node, mssg, StatusInternalError, true, err.Error())
+	}
+	rev := strconv.FormatUint(version.Revision, 10)
+	tmp := filepath.Join(dir, rev+".tmp")
+	dst, err := os.Create(tmp)
+	if err != nil {
+		return responseFormat(node, mssg, StatusInternalError, true, err.Error())
+	}
+	if body != nil {
+		_, err = io.Copy(dst, body)
+	}
+	if e := dst.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		versionJson, _ := json.Marshal(&version)
+		err = os.WriteFile(filepath.Join(dir, rev+".json"), versionJson, 0666)
+	}
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(dir, rev))
+	}
+	if err != nil {
+		log.Printf("(HandleCodeTransferVersion) saving revision %s of %q failed: %q\n", rev, version.Name, err)
+		os.Remove(tmp)
+		return responseFormat(node, mssg, StatusInternalError, true, err.Error())
+	}
+	return responseFormat(node, mssg, StatusOk, true, "")
+}
+
+// dropSelf removes this node from the online nodes and tells every other node right away
+func dropSelf(node *NodeConfig) {
+	self := node.Node.Oauth.UserName
+	node.deleteNode(self, updateTimeNow(CodeNodes, self, ""))
+	drop := nodesDelta(CodeDrop, self, node.Node)
+	dropOutboxes(node)
+	sendUpdates(node, &drop)
+}
+
+func (node *NodeConfig) HandleCodeTransferFile(mssg *Message, body io.Reader) *Message {
+	var fileExternal File
+	if err := json.Unmarshal([]byte(mssg.Body.Content), &fileExternal); err != nil {
+		return responseFormat(node, mssg, StatusBadFormat, true, err.Error())
+	}
+	name, err := ParseFileName(fileExternal.Name)
+	if err != nil || string(name) != fileExternal.Name {
+		return responseFormat(node, mssg, StatusBadFileName, true, fileExternal.Name)
+	}
+	if node.isDraining() {
+		return responseFormat(node, mssg, StatusNodeDraining, true, "")
+	}
+	// only the owner gives a file away
+	f, ok := node.getFile(string(name))
+	if !ok || f.Owner != mssg.Header.Node.Oauth.UserName {
+		return responseFormat(node, mssg, StatusFileNotFound, true, fileExternal.Name)
+	}
+
+	if f.IsDir {
+		err = createDir(node, name)
+	} else {
+		err = receiveFile(node, name, body)
+	}
+	if err != nil {
+		log.Printf("(HandleCodeTransferFile) receiving %q failed: %q\n", f.Name, err)
+		return responseFormat(node, mssg, StatusInternalError, true, err.Error())
+	}
+
+	replicas := []string{}
+	for _, r := range f.Replicas {
+		if r != node.Node.Oauth.UserName {
+			replicas = append(replicas, r)
+		}
+	}
+	f.Owner = node.Node.Oauth.UserName
+	f.Replicas = replicas
+	f = fileMetadata(node, f)
+	f = clientMakeCUD(node, f, updateTimeNow(CodeUpdateFile, node.Node.Oauth.UserName, ""))
+	node.createFile(f)
+	node.queueReplication(f.Name)
+	return responseFormat(node, mssg, StatusOk, true, "")
+}
+
+// receiveFile replaces the content of fileName with body, the file is only replaced once body was read
+func receiveFile(node *NodeConfig, fileName FileName, body io.Reader) error {
+	if err := createFile(node, fileName); err != nil {
+		return err
+	}
+	if body == nil {
+		body = strings.NewReader("")
+	}
+	return node.Storage.Write(fileName, body)
+}
+
+func (node *NodeConfig) beginDrain() bool {
+	// creations and writes in progress end before the owned files are listed
+	node.writeMx.Lock()
+	defer node.writeMx.Unlock()
+	node.drainMx.Lock()
+	defer node.drainMx.Unlock()
+	if node.draining {
+		return false
+	}
+	node.draining = true
+	return true
+}
+
+func (node *NodeConfig) endDrain() {
+	node.drainMx.Lock()
+	defer node.drainMx.Unlock()
+	node.draining = false
+}
+
+func (node *NodeConfig) isDraining() bool {
+	node.drainMx.Lock()
+	defer node.drainMx.Unlock()
+	return node.draining
+}
@@ -0,0 +1,120 @@
+package node
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// BULLY ELECTION OF A NEW MESH INITIATOR
+//
+// When the failure detector confirms the mesh initiator dead, gossip included(memberGone), a node sends CodeElection
+// to every node with a higher username. If none of them answers, the node becomes the mesh initiator and announces it
+// with CodeCoordinator.
+// Otherwise it waits for the coordinator, if none is announced within coordinatorTimeout the election starts again.
+// A coordinator with a lower username than ours is refused and we start an election, the highest node must win.
+
+const coordinatorTimeout = 10 * time.Second
+
+func startElection(node *NodeConfig) {
+	if !node.beginElection() {
+		return
+	}
+	defer node.endElection()
+
+	log.Printf("Node(%s) starting mesh initiator election\n", node.Node.Oauth.UserName)
+	mssg := Message{
+		Header: MessageHeader{
+			Node: node.Node,
+		},
+		Body: MessageBody{
+			Code: CodeElection,
+		},
+	}
+
+	higher := []Node{}
+	for _, _node := range copyNodesAddress(node) {
+		if _node.Oauth.UserName > node.Node.Oauth.UserName {
+			higher = append(higher, _node)
+		}
+	}
+	// a single node taking over is enough
+	results := node.fanOut(context.Background(), higher, &mssg, 0, FanOutResult.ok)
+	for _, res := range results {
+		if res.ok() {
+			log.Printf("Node(%s) took over the election\n", res.Node.Oauth.UserName)
+			go awaitCoordinator(node, time.Now())
+			return
+		}
+		if res.Err != nil {
+			log.Printf("(startElection) dialing node(%s) error: %q\n", res.Node.Oauth.UserName, res.Err)
+		}
+	}
+
+	becomeMeshInitiator(node)
+}
+
+// awaitCoordinator starts the election again if no coordinator was announced since, the node that took over may have died
+func awaitCoordinator(node *NodeConfig, since time.Time) {
+	timer := time.NewTimer(coordinatorTimeout)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-node.stopNode:
+		return
+	}
+	node.electionMx.Lock()
+	announced := !node.coordinatorAt.Before(since)
+	node.electionMx.Unlock()
+	if !announced {
+		log.Printf("Node(%s) no coordinator was announced, electing again\n", node.Node.Oauth.UserName)
+		startElection(node)
+	}
+}
+
+func becomeMeshInitiator(node *NodeConfig) {
+	log.Printf("Node(%s) is the new mesh initiator %q\n", node.Node.Oauth.UserName, node.Node.Address)
+	node.SetMeshInitiator(Node{})
+
+	mssg := Message{
+		Header: MessageHeader{
+			Node: node.Node,
+		},
+		Body: MessageBody{
+			Code: CodeCoordinator,
+		},
+	}
+	for _, res := range node.fanOut(context.Background(), copyNodesAddress(node), &mssg, 0, nil) {
+		if res.Err != nil {
+			log.Printf("(becomeMeshInitiator) dialing node(%s) error: %q\n", res.Node.Oauth.UserName, res.Err)
+			continue
+		}
+		if res.Response.Body.Status != StatusOk {
+			log.Printf("Node(%s) coordinator responded with %q\n", res.Node.Oauth.UserName, res.Response.Body.Status)
+		}
+	}
+}
+
+func (node *NodeConfig) HandleCodeElection(mssg *Message) *Message {
+	// only nodes with a higher username can take over an election
+	if mssg.Header.Node.Oauth.UserName >= node.Node.Oauth.UserName {
+		return responseFormat(node, mssg, StatusBadFormat, true, "")
+	}
+	go startElection(node)
+	return responseFormat(node, mssg, StatusOk, true, "")
+}
+
+func (node *NodeConfig) HandleCodeCoordinator(mssg *Message) *Message {
+	// a lower node won a race, this node takes over
+	if mssg.Header.Node.Oauth.UserName < node.Node.Oauth.UserName {
+		log.Printf("Node(%s) announced itself as mesh initiator, refused\n", mssg.Header.Node.Oauth.UserName)
+		go startElection(node)
+		return responseFormat(node, mssg, StatusBadFormat, true, "")
+	}
+	log.Printf("Node(%s) announced itself as mesh initiator\n", mssg.Header.Node.Oauth.UserName)
+	node.electionMx.Lock()
+	node.coordinatorAt = time.Now()
+	node.electionMx.Unlock()
+	node.SetMeshInitiator(mssg.Header.Node)
+	return responseFormat(node, mssg, StatusOk, true, "")
+}
@@ -0,0 +1,104 @@
+package node
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MESSAGES TO MANY NODES ARE SENT IN PARALLEL
+//
+// A broadcast(elections, indirect probes, updates of a leaving node) is sent by a pool of at most FanOut workers,
+// every peer with its own deadline, so it takes about as long as its slowest peer instead of the sum of all of them.
+// The outboxes share FanOut slots too, however many peers are waiting for updates.
+
+const defaultFanOut = 32
+
+// FanOutResult is the answer of one peer to a broadcast
+type FanOutResult struct {
+	Node     Node
+	Response *Message
+	Err      error
+	Duration time.Duration
+}
+
+// ok reports whether the peer answered StatusOk
+func (r FanOutResult) ok() bool {
+	return r.Err == nil && r.Response != nil && r.Response.Body.Status == StatusOk
+}
+
+// fanOut sends mssg to every peer, each send gives up after timeout(only RequestTimeout applies if it is 0).
+// Once done returns true for a result the peers left are not sent to. Results come in the order peers answered
+func (node *NodeConfig) fanOut(ctx context.Context, peers []Node, mssg *Message, timeout time.Duration, done func(FanOutResult) bool) []FanOutResult {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	workers := node.FanOut
+	if workers > len(peers) {
+		workers = len(peers)
+	}
+	jobs := make(chan Node)
+	results := make(chan FanOutResult, len(peers))
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range jobs {
+				results <- node.sendPeer(ctx, n, mssg, timeout)
+			}
+		}()
+	}
+	go func() {
+		defer close(jobs)
+		for _, n := range peers {
+			select {
+			case jobs <- n:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	all := make([]FanOutResult, 0, len(peers))
+	for res := range results {
+		all = append(all, res)
+		if done != nil && done(res) {
+			// the sends in progress are cancelled
+			cancel()
+		}
+	}
+	return all
+}
+
+// sendPeer is send to a single peer of a broadcast
+func (node *NodeConfig) sendPeer(ctx context.Context, n Node, mssg *Message, timeout time.Duration) FanOutResult {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	peerMssg := *mssg
+	peerMssg.Header.Destination = n.Oauth.UserName
+	start := time.Now()
+	resMssg, err := node.send(ctx, n.Address, &peerMssg)
+	return FanOutResult{Node: n, Response: resMssg, Err: err, Duration: time.Since(start)}
+}
+
+// acquireFanOut takes one of the FanOut slots shared by the outboxes, false if the node stopped first
+func (node *NodeConfig) acquireFanOut() bool {
+	select {
+	case node.fanOutSlots <- true:
+		return true
+	case <-node.stopNode:
+		return false
+	}
+}
+
+func (node *NodeConfig) releaseFanOut() {
+	<-node.fanOutSlots
+}
@@ -0,0 +1,135 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mean round trip of a simulated peer
+const benchLatency = time.Millisecond
+
+// simulatedMesh answers for the peers of the benchmarked node and records when they get an update
+type simulatedMesh struct {
+	mx       sync.Mutex
+	received map[string]map[string]bool
+	waiting  map[string]chan bool
+	// peers expected to get each update
+	reachable int
+	// update messages received by the peers
+	messages int
+}
+
+func (mesh *simulatedMesh) netClient(ctx context.Context, remoteAddr string, message *Message) (*Message, error) {
+	wait := time.Duration(rand.Int63n(int64(2*benchLatency) + 1))
+	select {
+	case <-time.After(wait):
+	case <-ctx.Done():
+		return &Message{}, ctx.Err()
+	}
+
+	var batch []UpdateTime
+	switch message.Body.Code {
+	case CodeUpdate:
+		var updates UpdateTime
+		if json.Unmarshal([]byte(message.Body.Content), &updates) == nil {
+			batch = append(batch, updates)
+		}
+	case CodeUpdateBatch:
+		json.Unmarshal([]byte(message.Body.Content), &batch)
+	default:
+		return signedBy(peerKey, remoteAddr, &Message{Body: MessageBody{Code: CodeResponse, Status: StatusOk}}), nil
+	}
+	mesh.mx.Lock()
+	mesh.messages++
+	mesh.mx.Unlock()
+	for _, updates := range batch {
+		var f File
+		if json.Unmarshal([]byte(updates.Content), &f) == nil {
+			mesh.receive(f.Name, message.Header.Destination)
+		}
+	}
+	// peers are named after their address
+	return signedBy(peerKey, remoteAddr, &Message{Body: MessageBody{Code: CodeResponse, Status: StatusOk}}), nil
+}
+
+func (mesh *simulatedMesh) expect(name string) chan bool {
+	mesh.mx.Lock()
+	defer mesh.mx.Unlock()
+	mesh.received[name] = map[string]bool{}
+	mesh.waiting[name] = make(chan bool)
+	return mesh.waiting[name]
+}
+
+func (mesh *simulatedMesh) receive(name, peer string) {
+	mesh.mx.Lock()
+	defer mesh.mx.Unlock()
+	got, ok := mesh.received[name]
+	if !ok || got[peer] {
+		return
+	}
+	got[peer] = true
+	if len(got) == mesh.reachable {
+		close(mesh.waiting[name])
+	}
+}
+
+// BenchmarkBroadcast measures how long a new directory takes to reach every peer of a simulated mesh,
+// one peer at a time(fanout=1) and through the default worker pool
+func BenchmarkBroadcast(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	for _, size := range []int{10, 100, 1000} {
+		for _, fanOut := range []int{1, defaultFanOut} {
+			b.Run(fmt.Sprintf("nodes=%d/fanout=%d", size, fanOut), func(b *testing.B) {
+				benchBroadcast(b, size, fanOut)
+			})
+		}
+	}
+}
+
+func benchBroadcast(b *testing.B, size, fanOut int) {
+	mesh := &simulatedMesh{received: map[string]map[string]bool{}, waiting: map[string]chan bool{}}
+	temp := NodeConfig{
+		BaseFilePath:   b.TempDir(),
+		Storage:        &MemoryStorage{},
+		PublicAddr:     &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1},
+		RequestTimeout: time.Second,
+		FanOut:         fanOut,
+	}
+	temp.Node.Oauth.UserName = "bench"
+	temp.Record.OnlineNodes.NodesList = map[string]Node{}
+	for i := 1; i < size; i++ {
+		name := fmt.Sprintf("peer%04d", i)
+		temp.Record.OnlineNodes.NodesList[name] = Node{Address: name, PublicKey: encodePublicKey(peerKey), Oauth: Oauth{UserName: name}}
+		mesh.reachable++
+	}
+	n := MustInitServer(temp, "", mesh.netClient)
+	defer n.Stop()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		name := fmt.Sprintf("bench-%d", i)
+		done := mesh.expect(name)
+		if mssg := n.ClientCreateDir(name); mssg.Status != StatusOk {
+			b.Fatalf("Creating %q failed: %s", name, mssg.Status)
+		}
+		select {
+		case <-done:
+		case <-time.After(time.Minute):
+			b.Fatalf("%q did not reach %d peers", name, mesh.reachable)
+		}
+	}
+	b.StopTimer()
+	mesh.mx.Lock()
+	b.ReportMetric(float64(mesh.messages)/float64(b.N), "msgs/op")
+	mesh.mx.Unlock()
+}
@@ -0,0 +1,63 @@
+package node
+
+import (
+	"errors"
+	"path"
+	"strings"
+)
+
+// FileName is a validated, canonical slash-separated path relative to the base directory of a node.
+// Names coming from clients or other nodes must go through ParseFileName before touching the disk.
+type FileName string
+
+const (
+	maxFileNameLength      = 4096
+	maxFileComponentLength = 255
+)
+
+var (
+	errBadFileName = errors.New("bad file name")
+	errSymlink     = errors.New("symbolic links are not shared")
+)
+
+// ParseFileName validates name. Surrounding slashes are trimmed, any other non-canonical form is rejected
+func ParseFileName(name string) (FileName, error) {
+	name = strings.Trim(name, "/")
+	if name == "" || len(name) > maxFileNameLength {
+		return "", errBadFileName
+	}
+	if strings.ContainsAny(name, "\x00\\") {
+		return "", errBadFileName
+	}
+
+	for i, component := range strings.Split(name, "/") {
+		switch component {
+		case "", ".", "..":
+			return "", errBadFileName
+		}
+		if len(component) > maxFileComponentLength {
+			return "", errBadFileName
+		}
+		// the state store is reserved
+		if i == 0 && component == stateDirName {
+			return "", errBadFileName
+		}
+	}
+	return FileName(name), nil
+}
+
+// parseDirName is ParseFileName that also accepts the root directory("")
+func parseDirName(name string) (FileName, error) {
+	if strings.Trim(name, "/") == "" {
+		return "", nil
+	}
+	return ParseFileName(name)
+}
+
+func parentDir(name FileName) FileName {
+	dir := path.Dir(string(name))
+	if dir == "." {
+		return ""
+	}
+	return FileName(dir)
+}
@@ -0,0 +1,99 @@
+package node
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func FuzzParseFileName(f *testing.F) {
+	for _, seed := range []string{
+		"a", "/a/b/", "a//b", "a/./b", "../a", "a/..", ".webdir/record.json", "b/.webdir",
+		"a\\b", "a\x00b", "", "/", strings.Repeat("x", maxFileComponentLength+1),
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, name string) {
+		parsed, err := ParseFileName(name)
+		if err != nil {
+			if parsed != "" {
+				t.Fatalf("ParseFileName(%q) returned %q with an error", name, parsed)
+			}
+			return
+		}
+		s := string(parsed)
+		if s == "" || path.Clean(s) != s || path.IsAbs(s) || strings.HasPrefix(s, "../") || s == ".." {
+			t.Fatalf("ParseFileName(%q) = %q is not canonical", name, parsed)
+		}
+		if strings.ContainsAny(s, "\x00\\") || len(s) > maxFileNameLength {
+			t.Fatalf("ParseFileName(%q) = %q has a forbidden character or length", name, parsed)
+		}
+		if s == stateDirName || strings.HasPrefix(s, stateDirName+"/") {
+			t.Fatalf("ParseFileName(%q) = %q is in the state store", name, parsed)
+		}
+		if again, err := ParseFileName(s); err != nil || again != parsed {
+			t.Fatalf("ParseFileName(%q) = %q, %v; want %q", s, again, err, parsed)
+		}
+
+		root := filepath.FromSlash("/base")
+		joined := filepath.Join(root, filepath.FromSlash(s))
+		if rel, err := filepath.Rel(root, joined); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			t.Fatalf("ParseFileName(%q) = %q escapes the base directory", name, parsed)
+		}
+	})
+}
+
+func TestLocalStoragePathSymlink(t *testing.T) {
+	root, outside := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "link")); err != nil {
+		t.Skipf("symbolic links not supported: %v", err)
+	}
+	if err := os.Mkdir(filepath.Join(root, "dir"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "secret"), filepath.Join(root, "dir", "file")); err != nil {
+		t.Fatal(err)
+	}
+	s := &LocalStorage{Root: root}
+
+	for _, name := range []FileName{"link", "link/secret", "link/new/file", "dir/file"} {
+		if _, err := s.path(name); !errors.Is(err, errSymlink) {
+			t.Errorf("path(%q) error = %v, want %v", name, err, errSymlink)
+		}
+	}
+	if _, err := s.Read("link/secret", 0, 0); err == nil {
+		t.Errorf("Read through a symbolic link succeeded")
+	}
+	if err := s.Create("link/new", false); err == nil {
+		t.Errorf("Create through a symbolic link succeeded")
+	}
+	if _, err := os.Lstat(filepath.Join(outside, "new")); !os.IsNotExist(err) {
+		t.Errorf("a file was created outside the root: %v", err)
+	}
+	if err := s.Write("dir/file", strings.NewReader("overwritten")); err == nil {
+		t.Errorf("Write to a symbolic link succeeded")
+	}
+	if raw, _ := os.ReadFile(filepath.Join(outside, "secret")); string(raw) != "secret" {
+		t.Errorf("file outside the root was changed to %q", raw)
+	}
+
+	for _, name := range []FileName{"", "dir", "dir/missing", "missing/a/b"} {
+		p, err := s.path(name)
+		if err != nil {
+			t.Errorf("path(%q) error = %v", name, err)
+			continue
+		}
+		if want := filepath.Join(root, filepath.FromSlash(string(name))); p != want {
+			t.Errorf("path(%q) = %q, want %q", name, p, want)
+		}
+	}
+	if _, err := s.path("../escape"); err == nil {
+		t.Errorf("path(%q) succeeded", "../escape")
+	}
+}
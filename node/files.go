@@ -1,6 +1,10 @@
 package node
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/fs"
 	"log"
 	"os"
 	"path/filepath"
@@ -11,6 +15,10 @@ func initBaseDir(node *NodeConfig) error {
 		node.BaseFilePath = filepath.Join(os.Getenv("HOME"), "webdir")
 	}
 
+	if node.Storage == nil {
+		node.Storage = &LocalStorage{Root: node.BaseFilePath}
+	}
+
 	_, err := os.Stat(node.BaseFilePath)
 	if err != nil && !os.IsNotExist(err) {
 		return err
@@ -19,42 +27,110 @@ func initBaseDir(node *NodeConfig) error {
 }
 
 func addOwnedFiles(node *NodeConfig) error {
-	return filepath.WalkDir(node.BaseFilePath, func(path string, dirEntry os.DirEntry, err error) error {
-		if err != nil {
-			return nil
+	found := map[string]bool{}
+	infos, err := node.Storage.List()
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		name := string(info.Name)
+		if info.IsDir {
+			// the directory may already be known to the mesh, files inside it are still owned by this node
+			if m := node.ClientCreateDir(name); m.Status != StatusOk && m.Status != StatusFileExist {
+				log.Printf("Failed to add directory %q. Node responded with %q\n", name, m.Status)
+			}
+			continue
 		}
 
-		// Since we only share files, we will skip all other sub-directories in our base directory
-		if dirEntry.IsDir() {
-			if path == node.BaseFilePath {
-				return nil
+		found[name] = true
+		log.Printf("Adding %q to owned files...\n", name)
+		m := node.ClientCreateFile(name)
+		if m.Status == StatusFileExist && m.Content == node.Node.Oauth.UserName {
+			// metadata was recovered from the state store, let the mesh know about it
+			f, _ := node.getFile(name)
+			if fileMetadata(node, f).SHA256 != f.SHA256 {
+				// changed while the node was offline
+				node.ownedFileWritten(f, node.Node.Oauth.UserName)
+			} else {
+				announceFile(node, f)
 			}
-			return filepath.SkipDir
+		} else if m.Status != StatusOk {
+			log.Printf("Failed to add %q to owned files. Node responded with %q\n", name, m.Status)
 		}
-		log.Printf("Adding %q to owned files...\n", path)
-		if m := node.ClientCreateFile(dirEntry.Name()); m.Status != StatusOk {
-			log.Printf("Failed to add %q to owned files. Node responded with %q\n", path, m.Status)
+	}
+
+	// files recovered from the state store that were removed while the node was offline
+	for _, f := range ownedFiles(node) {
+		if !f.IsDir && !found[f.Name] {
+			log.Printf("Owned file %q no longer exists, removing it...\n", f.Name)
+			updates := updateTimeNow(CodeDeleteFile, node.Node.Oauth.UserName, "")
+			clientMakeCUD(node, f, updates)
+			node.deleteFile(f.Name, updates)
 		}
-		return nil
-	})
+	}
+	return nil
 }
 
-func readFile(nd *NodeConfig, fileName string) ([]byte, error) {
-	return os.ReadFile(filepath.Join(nd.BaseFilePath, fileName))
+func ownedFiles(node *NodeConfig) []File {
+	node.dirsRwMx.RLock()
+	defer node.dirsRwMx.RUnlock()
+	files := []File{}
+	for _, f := range node.Record.Directory.FilesList {
+		if f.Owner == node.Node.Oauth.UserName {
+			files = append(files, f)
+		}
+	}
+	return files
 }
 
-func writeFile(nd *NodeConfig, fileName string, data []byte) error {
-	return os.WriteFile(filepath.Join(nd.BaseFilePath, fileName), data, 0666)
+// announceFile publishes an existing file as created, its original metadata is kept
+func announceFile(node *NodeConfig, f File) {
+	fileJson, _ := json.Marshal(&f)
+	update := updateTimeNow(CodeCreateFile, node.Node.Oauth.UserName, string(fileJson))
+	node.queueUpdate(update)
 }
 
-func deleteFile(nd *NodeConfig, fileName string) error {
-	return os.Remove(filepath.Join(nd.BaseFilePath, fileName))
+func writeFile(nd *NodeConfig, fileName FileName, data []byte) error {
+	return nd.Storage.Write(fileName, bytes.NewReader(data))
 }
 
-func createFile(nd *NodeConfig, fileName string) error {
-	f, err := os.OpenFile(filepath.Join(nd.BaseFilePath, fileName), os.O_CREATE|os.O_RDONLY, 0666)
-	if err != nil {
-		return err
+// writeFileAt writes data at offset of an existing file, a negative offset appends
+func writeFileAt(nd *NodeConfig, fileName FileName, data []byte, offset int64) error {
+	return writeStorageAt(nd.Storage, fileName, data, offset)
+}
+
+func deleteFile(nd *NodeConfig, fileName FileName) error {
+	return nd.Storage.Delete(fileName)
+}
+
+// createFile creates an empty file if it doesn't exist, the parent directory may be owned by another node
+func createFile(nd *NodeConfig, fileName FileName) error {
+	return nd.Storage.Create(fileName, false)
+}
+
+func createDir(nd *NodeConfig, dirName FileName) error {
+	return nd.Storage.Create(dirName, true)
+}
+
+// deleteDir removes the local copy of an empty directory, a node may not have one
+func deleteDir(nd *NodeConfig, dirName FileName) error {
+	err := nd.Storage.Delete(dirName)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
 	}
-	return f.Close()
+	return err
+}
+
+// renameDir moves the local copy of a directory, a node may not have one
+func renameDir(nd *NodeConfig, dirName, newName FileName) error {
+	if _, err := nd.Storage.Stat(dirName); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return nd.Storage.Rename(dirName, newName)
+}
+
+// fileExists reports whether the storage has fileName
+func fileExists(nd *NodeConfig, fileName FileName) bool {
+	_, err := nd.Storage.Stat(fileName)
+	return err == nil
 }
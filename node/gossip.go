@@ -0,0 +1,330 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// SWIM-STYLE MEMBERSHIP AND FAILURE DETECTION
+//
+// Every probeInterval each node pings one random peer. If the peer doesn't answer, up to indirectProbes other
+// nodes are asked to ping it with CodePingReq. If none of them reaches it, the peer becomes suspect and
+// is confirmed dead(CodeDrop) after suspectTimeout unless it refutes the suspicion with a higher incarnation.
+//
+// Membership changes are not sent on their own, they are piggybacked on the header of every signed message.
+// A dead mesh initiator starts an election.
+
+const (
+	probeTimeout   = 2 * time.Second
+	indirectProbes = 3
+	suspectTimeout = 5 * time.Second
+	// a dead node is forgotten after deadTimeout, its incarnation rejects older gossip until then
+	deadTimeout = time.Minute
+	// membership updates piggybacked on a single message
+	maxPiggyback = 8
+)
+
+var errProbeTimeout = errors.New("probe timed out")
+
+type MemberState string
+
+const (
+	MemberAlive   MemberState = "alive"
+	MemberSuspect MemberState = "suspect"
+	MemberDead    MemberState = "dead"
+)
+
+// MemberUpdate is piggybacked on messages, a node refutes a suspicion by raising its incarnation
+type MemberUpdate struct {
+	Node        string      `json:"node"`
+	State       MemberState `json:"state"`
+	Incarnation uint64      `json:"incarnation"`
+}
+
+type member struct {
+	state       MemberState
+	incarnation uint64
+	since       time.Time
+}
+
+type gossipItem struct {
+	update MemberUpdate
+	sent   int
+}
+
+func (node *NodeConfig) HandleCodePingReq(mssg *Message) *Message {
+	target, ok := node.getNode(mssg.Body.Content)
+	if !ok {
+		return responseFormat(node, mssg, StatusNodeNotOnline, true, mssg.Body.Content)
+	}
+	if !pingNode(node, target) {
+		return responseFormat(node, mssg, StatusNodeNotOnline, true, target.Oauth.UserName)
+	}
+	return responseFormat(node, mssg, StatusOk, true, "")
+}
+
+// probeRandomNode runs one round of the failure detector
+func probeRandomNode(node *NodeConfig) {
+	peers := copyNodesAddress(node)
+	if len(peers) == 0 {
+		return
+	}
+	target := peers[rand.Intn(len(peers))]
+	if pingNode(node, target) {
+		return
+	}
+
+	// maybe only the link between the two nodes is broken, ask others
+	rand.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+	helpers := []Node{}
+	for _, helper := range peers {
+		if helper.Oauth.UserName != target.Oauth.UserName && len(helpers) < indirectProbes {
+			helpers = append(helpers, helper)
+		}
+	}
+	mssg := Message{
+		Header: MessageHeader{
+			Node: node.Node,
+		},
+		Body: *messageBodyFormat(CodePingReq, "", target.Oauth.UserName),
+	}
+	// all helpers are asked at once, the first that reaches the target is enough
+	for _, res := range node.fanOut(context.Background(), helpers, &mssg, 2*probeTimeout, FanOutResult.ok) {
+		if res.ok() {
+			return
+		}
+	}
+
+	log.Printf("(probeRandomNode) node(%s) could not be reached at(%s), suspecting it\n", target.Oauth.UserName, target.Address)
+	node.suspectMember(target.Oauth.UserName)
+}
+
+func pingNode(node *NodeConfig, n Node) bool {
+	mssg := Message{
+		Header: MessageHeader{
+			Node:        node.Node,
+			Destination: n.Oauth.UserName,
+		},
+		Body: MessageBody{
+			Code: CodePing,
+		},
+	}
+	resMssg, err := node.sendTimeout(n.Address, &mssg, probeTimeout)
+	return err == nil && resMssg.Body.Status == StatusOk
+}
+
+// sendTimeout is send that gives up after timeout, a slow node must not hold the failure detector
+func (node *NodeConfig) sendTimeout(address string, mssg *Message, timeout time.Duration) (*Message, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	resMssg, err := node.send(ctx, address, mssg)
+	if err != nil && ctx.Err() != nil {
+		return &Message{}, errProbeTimeout
+	}
+	return resMssg, err
+}
+
+func (node *NodeConfig) suspectMember(name string) {
+	node.membersMx.Lock()
+	defer node.membersMx.Unlock()
+	m := node.memberLocked(name)
+	if m.state != MemberAlive {
+		return
+	}
+	m.state, m.since = MemberSuspect, time.Now()
+	node.queueGossipLocked(MemberUpdate{Node: name, State: MemberSuspect, Incarnation: m.incarnation})
+}
+
+// confirmSuspects drops the nodes that stayed suspect for suspectTimeout
+func confirmSuspects(node *NodeConfig) {
+	dead := []string{}
+	node.membersMx.Lock()
+	for name, m := range node.members {
+		if m.state == MemberDead && time.Since(m.since) > deadTimeout {
+			delete(node.members, name)
+			continue
+		}
+		if m.state == MemberSuspect && time.Since(m.since) > suspectTimeout {
+			m.state, m.since = MemberDead, time.Now()
+			node.queueGossipLocked(MemberUpdate{Node: name, State: MemberDead, Incarnation: m.incarnation})
+			dead = append(dead, name)
+		}
+	}
+	node.membersMx.Unlock()
+
+	for _, name := range dead {
+		if n, ok := node.getNode(name); ok {
+			log.Printf("Node(%s) confirmed dead\n", name)
+			removeNodes(node, n)
+			node.memberGone(name)
+		}
+	}
+}
+
+// memberGone starts an election if name was the mesh initiator
+func (node *NodeConfig) memberGone(name string) {
+	if !node.isMeshInitiator() && node.meshInitiator().Oauth.UserName == name {
+		go startElection(node)
+	}
+}
+
+// memberJoined makes a node that registered again alive, so it can be suspected and dropped again.
+// Its incarnation is kept, older gossip about it is still ignored
+func (node *NodeConfig) memberJoined(name string) {
+	node.membersMx.Lock()
+	defer node.membersMx.Unlock()
+	if m, ok := node.members[name]; ok && m.state != MemberAlive {
+		m.state, m.since = MemberAlive, time.Now()
+	}
+}
+
+// memberLocked returns the state of name, nodes never heard of are alive
+func (node *NodeConfig) memberLocked(name string) *member {
+	m, ok := node.members[name]
+	if !ok {
+		m = &member{state: MemberAlive}
+		node.members[name] = m
+	}
+	return m
+}
+
+// receiveGossip applies the membership updates piggybacked on mssg
+func (node *NodeConfig) receiveGossip(mssg *Message) {
+	if len(mssg.Header.Gossip) == 0 {
+		return
+	}
+	self := node.Node.Oauth.UserName
+	removed := []string{}
+	rejoin := false
+
+	node.membersMx.Lock()
+	for _, u := range mssg.Header.Gossip {
+		if u.Node == self {
+			if u.State != MemberAlive && u.Incarnation >= node.incarnation {
+				// refute, the higher incarnation overrides the suspicion everywhere
+				node.incarnation = u.Incarnation + 1
+				node.queueGossipLocked(MemberUpdate{Node: self, State: MemberAlive, Incarnation: node.incarnation})
+				rejoin = rejoin || u.State == MemberDead
+			}
+			continue
+		}
+		if _, ok := node.getNode(u.Node); !ok {
+			// nodes join with CodeRegister
+			continue
+		}
+
+		m := node.memberLocked(u.Node)
+		switch u.State {
+		case MemberAlive:
+			if u.Incarnation <= m.incarnation {
+				continue
+			}
+			m.state = MemberAlive
+		case MemberSuspect:
+			if u.Incarnation < m.incarnation || (u.Incarnation == m.incarnation && m.state != MemberAlive) {
+				continue
+			}
+			m.state, m.since = MemberSuspect, time.Now()
+		case MemberDead:
+			if u.Incarnation < m.incarnation || (u.Incarnation == m.incarnation && m.state == MemberDead) {
+				continue
+			}
+			m.state, m.since = MemberDead, time.Now()
+			removed = append(removed, u.Node)
+		default:
+			continue
+		}
+		m.incarnation = u.Incarnation
+		node.queueGossipLocked(u)
+	}
+	node.membersMx.Unlock()
+
+	for _, name := range removed {
+		log.Printf("Node(%s) is dead according to node(%s)\n", name, mssg.Header.Node.Oauth.UserName)
+		node.deleteNode(name, updateTimeNow(CodeNodes, mssg.Header.Node.Oauth.UserName, ""))
+		node.memberGone(name)
+	}
+	if rejoin {
+		go rejoinMesh(node)
+	}
+}
+
+// rejoinMesh registers again a node that the mesh declared dead
+func rejoinMesh(node *NodeConfig) {
+	log.Printf("Node(%s) was declared dead, registering again\n", node.Node.Oauth.UserName)
+	for _, n := range copyNodesAddress(node) {
+		if err := advertiseOnNetwork(node, n.Address); err == nil {
+			return
+		}
+	}
+}
+
+func (node *NodeConfig) gossipAlive() {
+	node.membersMx.Lock()
+	defer node.membersMx.Unlock()
+	node.queueGossipLocked(MemberUpdate{Node: node.Node.Oauth.UserName, State: MemberAlive, Incarnation: node.incarnation})
+}
+
+// queueGossipLocked replaces any pending update about the same node
+func (node *NodeConfig) queueGossipLocked(u MemberUpdate) {
+	for _, item := range node.gossip {
+		if item.update.Node == u.Node {
+			item.update, item.sent = u, 0
+			return
+		}
+	}
+	node.gossip = append(node.gossip, &gossipItem{update: u})
+}
+
+// piggyback returns the updates to put on the next message, the least sent first.
+// Each update is sent about 3*log2(n) times
+func (node *NodeConfig) piggyback() []MemberUpdate {
+	limit := 3
+	for n := node.onlineCount(); n > 1; n /= 2 {
+		limit += 3
+	}
+
+	node.membersMx.Lock()
+	defer node.membersMx.Unlock()
+	if len(node.gossip) == 0 {
+		return nil
+	}
+	sort.SliceStable(node.gossip, func(i, j int) bool { return node.gossip[i].sent < node.gossip[j].sent })
+	updates := []MemberUpdate{}
+	for i := 0; i < len(node.gossip) && i < maxPiggyback; i++ {
+		node.gossip[i].sent++
+		updates = append(updates, node.gossip[i].update)
+	}
+	kept := node.gossip[:0]
+	for _, item := range node.gossip {
+		if item.sent < limit {
+			kept = append(kept, item)
+		}
+	}
+	node.gossip = kept
+	return updates
+}
+
+// ClientMembers returns the failure detector's view of the online nodes
+func (node *NodeConfig) ClientMembers() *MessageBody {
+	members := map[string]MemberUpdate{}
+	for _, n := range copyNodesAddress(node) {
+		members[n.Oauth.UserName] = MemberUpdate{Node: n.Oauth.UserName, State: MemberAlive}
+	}
+	node.membersMx.Lock()
+	defer node.membersMx.Unlock()
+	for name := range members {
+		if m, ok := node.members[name]; ok {
+			members[name] = MemberUpdate{Node: name, State: m.state, Incarnation: m.incarnation}
+		}
+	}
+	self := node.Node.Oauth.UserName
+	members[self] = MemberUpdate{Node: self, State: MemberAlive, Incarnation: node.incarnation}
+	resBody, _ := json.Marshal(members)
+	return messageBodyFormat(CodeNone, StatusOk, string(resBody))
+}
@@ -2,23 +2,44 @@ package node
 
 import (
 	"encoding/json"
+	"errors"
+	"io"
 	"log"
+	"strconv"
 	"time"
 )
 
 // METHOD IN THIS FILE HANDLE MESSAGES SENT FROM ANOTHER NODE
 
 func (node *NodeConfig) NodeAuthorized(mssg *Message) *Message {
+	if mssg.Header.Destination != "" && mssg.Header.Destination != node.Node.Oauth.UserName {
+		return node.forward(mssg)
+	}
 	cl, ok := node.getNode(mssg.Header.Node.Oauth.UserName)
 	if mssg.Body.Code == CodeRegister {
-		return node.HandleCodeRegister(mssg)
+		// a new node proves it holds the private key of the public key it registers
+		if !node.verifyMessage(mssg, mssg.Header.Node.PublicKey) {
+			return responseFormat(node, mssg, StatusNotOauth, false, "")
+		}
+		res := node.HandleCodeRegister(mssg)
+		// the gossip of a new node is only applied once it is known
+		node.receiveGossip(mssg)
+		return res
 	}
-	if !ok || cl.Oauth.Password != mssg.Header.Node.Oauth.Password {
+	if !ok || !node.authorized(cl, mssg) {
 		return responseFormat(node, mssg, StatusNotOauth, false, "")
 	}
+	node.receiveGossip(mssg)
 	return node.Handle(mssg)
 }
 
+// authorized verifies that mssg was sent by the online node cl.
+// The certificate fingerprint in the header is only what the sender claims, with mutual TLS the transport checks the
+// certificate actually presented against the one cl registered with
+func (node *NodeConfig) authorized(cl Node, mssg *Message) bool {
+	return node.verifyMessage(mssg, cl.PublicKey)
+}
+
 func (node *NodeConfig) Handle(mssg *Message) *Message {
 	switch mssg.Body.Code {
 	case CodeRegister:
@@ -31,8 +52,26 @@ func (node *NodeConfig) Handle(mssg *Message) *Message {
 		return node.HandleCodeDeleteFile(mssg)
 	case CodeUpdate:
 		return node.HandleCodeUpdate(mssg)
+	case CodeUpdateBatch:
+		return node.HandleCodeUpdateBatch(mssg)
 	case CodePing:
 		return node.HandleCodePing(mssg)
+	case CodeElection:
+		return node.HandleCodeElection(mssg)
+	case CodeCoordinator:
+		return node.HandleCodeCoordinator(mssg)
+	case CodePingReq:
+		return node.HandleCodePingReq(mssg)
+	case CodeDigest:
+		return node.HandleCodeDigest(mssg)
+	case CodeListVersions:
+		return node.HandleCodeListVersions(mssg)
+	case CodeReadVersion:
+		return node.HandleCodeReadVersion(mssg)
+	case CodeDiffVersions:
+		return node.HandleCodeDiffVersions(mssg)
+	case CodeRestoreVersion:
+		return node.HandleCodeRestoreVersion(mssg)
 	default:
 		return responseFormat(node, mssg, StatusBadFormat, false, "")
 	}
@@ -41,17 +80,14 @@ func (node *NodeConfig) Handle(mssg *Message) *Message {
 func (node *NodeConfig) HandleCodeRegister(mssg *Message) *Message {
 	cl, ok := node.getNode(mssg.Header.Node.Oauth.UserName)
 	// check if this node is trying to register with existing username
-	if ok && cl.Oauth.Password != mssg.Header.Node.Oauth.Password {
+	if ok && (cl.PublicKey != mssg.Header.Node.PublicKey || cl.CertFingerprint != mssg.Header.Node.CertFingerprint) {
 		return responseFormat(node, mssg, StatusNodeExist, false, "")
 	}
 
 	// Otherwise its a new node or existing node with a changed IP address
-	updates := updateTimeNow(CodeRegister, node.Node.Oauth.UserName, "")
 	newNode := mssg.Header.Node
-	node.createNode(newNode, updates)
-	content, _ := node.marshalJSONNodes()
-	updates.Content = string(content)
-	node.updatesChan <- &updates
+	node.createNode(newNode, updateTimeNow(CodeRegister, node.Node.Oauth.UserName, ""))
+	node.queueUpdate(nodesDelta(CodeRegister, node.Node.Oauth.UserName, newNode))
 	resContent, _ := node.marshalJSONRecord()
 	return responseFormat(node, mssg, StatusOk, true, string(resContent))
 }
@@ -74,19 +110,41 @@ func (node *NodeConfig) HandleCodeGetInfo(mssg *Message) *Message {
 		resBody, _ = node.marshalJSONDirectory()
 
 	case CodeCreateFile, CodeUpdateFile, CodeDeleteFile:
-		f, ok := node.getFile(cont.Content)
+		name, err := ParseFileName(cont.Content)
+		if err != nil {
+			return responseFormat(node, mssg, StatusBadFileName, true, "")
+		}
+		f, ok := node.getFile(string(name))
 		if !ok || f.Owner != node.Node.Oauth.UserName {
 			return responseFormat(node, mssg, StatusFileNotFound, true, "")
 		}
 		resBody, _ = json.Marshal(&f)
 
 	case CodeReadFile:
-		f, ok := node.getFile(cont.Content)
-		if !ok || f.Owner != node.Node.Oauth.UserName {
-			return responseFormat(node, mssg, StatusFileNotFound, true, "")
+		// replica holders serve the file too
+		sf, status := node.openFile(cont.Content)
+		if status != StatusOk {
+			return responseFormat(node, mssg, status, true, "")
 		}
-
-		resBody, err = readFile(node, cont.Content)
+		if cont.Offset != 0 || cont.Length != 0 {
+			return node.readFileRange(mssg, sf, cont)
+		}
+		file, err := sf.open(0, 0)
+		if err != nil {
+			log.Printf("HandleCodeGetInfo error %q\n", err)
+			return responseFormat(node, mssg, StatusInternalError, true, err.Error())
+		}
+		data, err := io.ReadAll(file)
+		file.Close()
+		if err != nil {
+			log.Printf("HandleCodeGetInfo error %q\n", err)
+			return responseFormat(node, mssg, StatusInternalError, true, err.Error())
+		}
+		content, err := encodeContent(cont.Encoding, data)
+		if err != nil {
+			return responseFormat(node, mssg, StatusBadFormat, true, err.Error())
+		}
+		resBody = []byte(content)
 
 	case 0:
 		// Assume node just want all record
@@ -96,11 +154,41 @@ func (node *NodeConfig) HandleCodeGetInfo(mssg *Message) *Message {
 		return responseFormat(node, mssg, StatusBadFormat, true, "")
 	}
 
+	return responseFormat(node, mssg, StatusOk, true, string(resBody))
+}
+
+// readFileRange answers a ranged CodeReadFile
+func (node *NodeConfig) readFileRange(mssg *Message, sf storedFile, cont CodeInfoContent) *Message {
+	cont.Size = sf.size
+	if cont.Offset < 0 {
+		// the last -Offset bytes
+		cont.Offset += cont.Size
+		if cont.Offset < 0 {
+			cont.Offset = 0
+		}
+	}
+	if cont.Offset >= cont.Size || cont.Length < 0 {
+		return responseFormat(node, mssg, StatusBadOffset, true, strconv.FormatInt(cont.Size, 10))
+	}
+	if cont.Length == 0 || cont.Offset+cont.Length > cont.Size {
+		cont.Length = cont.Size - cont.Offset
+	}
+
+	file, err := sf.open(cont.Offset, cont.Length)
 	if err != nil {
-		log.Printf("HandleCodeGetInfo error %q\n", err)
+		log.Printf("(readFileRange) error %q\n", err)
 		return responseFormat(node, mssg, StatusInternalError, true, err.Error())
 	}
-
+	defer file.Close()
+	data := make([]byte, cont.Length)
+	if _, err := io.ReadFull(file, data); err != nil {
+		log.Printf("(readFileRange) error %q\n", err)
+		return responseFormat(node, mssg, StatusInternalError, true, err.Error())
+	}
+	if cont.Content, err = encodeContent(cont.Encoding, data); err != nil {
+		return responseFormat(node, mssg, StatusBadFormat, true, err.Error())
+	}
+	resBody, _ := json.Marshal(&cont)
 	return responseFormat(node, mssg, StatusOk, true, string(resBody))
 }
 
@@ -111,31 +199,96 @@ func (node *NodeConfig) HandleCodeUpdateFile(mssg *Message) *Message {
 		log.Printf("HandleCodeUpdateFile unmarshal error %q\n", err)
 		return responseFormat(node, mssg, StatusInternalError, true, err.Error())
 	}
-	f, ok := node.getFile(content.Name)
-	if !ok || f.Owner != node.Node.Oauth.UserName {
-		return responseFormat(node, mssg, StatusFileNotFound, true, "")
+	node.writeMx.Lock()
+	defer node.writeMx.Unlock()
+	name, f, status := node.ownedFile(content.Name)
+	if status != StatusOk {
+		return responseFormat(node, mssg, status, true, "")
+	}
+	if status := checkPreconditions(content, f); status != StatusOk {
+		return responseFormat(node, mssg, status, true, f.ETag())
 	}
-	if err := writeFile(node, content.Name, []byte(content.Content)); err != nil {
+	data, err := decodeContent(content.Encoding, content.Content)
+	if err != nil {
+		return responseFormat(node, mssg, StatusBadFormat, true, err.Error())
+	}
+	// partial writes
+	offset := int64(-1)
+	if content.Offset != nil && !content.Append {
+		info, err := node.Storage.Stat(name)
+		if err != nil {
+			return responseFormat(node, mssg, StatusInternalError, true, err.Error())
+		}
+		if offset = *content.Offset; offset < 0 || offset > info.Size {
+			return responseFormat(node, mssg, StatusBadOffset, true, strconv.FormatInt(info.Size, 10))
+		}
+	}
+
+	saveVersion(node, name, f)
+	if content.Offset != nil || content.Append {
+		err = writeFileAt(node, name, data, offset)
+	} else {
+		err = writeFile(node, name, data)
+	}
+	if err != nil {
 		log.Printf("HandleCodeUpdateFile write file error %q\n", err)
 		return responseFormat(node, mssg, StatusInternalError, true, err.Error())
 	}
 
+	f = node.ownedFileWritten(f, mssg.Header.Node.Oauth.UserName)
+	return responseFormat(node, mssg, StatusOk, true, f.ETag())
+}
+
+// ownedFile finds a regular file owned by this node
+func (node *NodeConfig) ownedFile(fileName string) (FileName, File, ResponseStatus) {
+	name, err := ParseFileName(fileName)
+	if err != nil {
+		return "", File{}, StatusBadFileName
+	}
+	f, ok := node.getFile(string(name))
+	if !ok || f.Owner != node.Node.Oauth.UserName {
+		return "", File{}, StatusFileNotFound
+	}
+	if f.IsDir {
+		return "", File{}, StatusIsDir
+	}
+	// the file is being handed over to another node
+	if node.isDraining() {
+		return "", File{}, StatusNodeDraining
+	}
+	return name, f, StatusOk
+}
+
+// ownedFileWritten publishes the update of an owned file once its content was written by node(by)
+func (node *NodeConfig) ownedFileWritten(f File, by string) File {
 	f.RecentUpdate.At = time.Now()
-	f.RecentUpdate.By = mssg.Header.Node.Oauth.UserName
+	f.RecentUpdate.By = by
 	f.RecentUpdate.Code = CodeUpdateFile
+	f.Revision++
+	f = fileMetadata(node, f)
 
-	node.createFile(clientMakeCUD(node, f, f.RecentUpdate))
-
-	return responseFormat(node, mssg, StatusOk, true, "")
+	f = clientMakeCUD(node, f, f.RecentUpdate)
+	node.createFile(f)
+	node.queueReplication(f.Name)
+	return f
 }
 
 func (node *NodeConfig) HandleCodeDeleteFile(mssg *Message) *Message {
-	f, ok := node.getFile(mssg.Body.Content)
-	if !ok || f.Owner != node.Node.Oauth.UserName {
-		return responseFormat(node, mssg, StatusFileNotFound, true, "")
+	var content UpdateFileContent
+	if err := json.Unmarshal([]byte(mssg.Body.Content), &content); err != nil {
+		return responseFormat(node, mssg, StatusBadFormat, true, err.Error())
+	}
+	node.writeMx.Lock()
+	defer node.writeMx.Unlock()
+	name, f, status := node.ownedFile(content.Name)
+	if status != StatusOk {
+		return responseFormat(node, mssg, status, true, "")
+	}
+	if status := checkPreconditions(content, f); status != StatusOk {
+		return responseFormat(node, mssg, status, true, f.ETag())
 	}
 
-	if err := deleteFile(node, f.Name); err != nil {
+	if err := deleteFile(node, name); err != nil {
 		log.Printf("(HandleCodeDeleteFile) error: %q\n", err)
 		return responseFormat(node, mssg, StatusInternalError, true, "")
 	}
@@ -148,6 +301,7 @@ func (node *NodeConfig) HandleCodeDeleteFile(mssg *Message) *Message {
 
 	clientMakeCUD(node, f, updates)
 	node.deleteFile(f.Name, updates)
+	deleteVersions(node, f)
 	return responseFormat(node, mssg, StatusOk, true, "")
 }
 
@@ -160,64 +314,163 @@ func (node *NodeConfig) HandleCodeUpdate(mssg *Message) *Message {
 		return responseFormat(node, mssg, StatusInternalError, true, err.Error())
 	}
 
-	switch updateContent.Code {
-	case CodeRegister, CodeNodes, CodeDrop:
-		var nodes OnlineNodes
-		err := json.Unmarshal([]byte(updateContent.Content), &nodes)
-		if err != nil {
-			log.Printf("(HandleCodeUpdate) unmarshalling(%q) OnlineNodes failed%q\n", updateContent.Content, err)
-			break
+	pending, status, content := decodeUpdate(mssg.Header.Node.Oauth.UserName, updateContent)
+	if status != StatusOk {
+		return responseFormat(node, mssg, status, true, content)
+	}
+	node.updateMx.Lock()
+	status, content = node.applyUpdate(pending)
+	node.updateMx.Unlock()
+	return responseFormat(node, mssg, status, true, content)
+}
+
+// pendingUpdate is an update of another node whose content was decoded, nothing was applied yet
+type pendingUpdate struct {
+	UpdateTime
+	// the node added or removed by CodeRegister and CodeDrop
+	node   Node
+	nodes  OnlineNodes
+	dir    Directory
+	file   File
+	name   FileName
+	rename RenameDirContent
+	to     FileName
+	// the neighbours published by the sender
+	neighbours NeighboursContent
+}
+
+// decodeUpdate checks updates received from sender without changing anything,
+// on failure the status and content of the response are returned
+func decodeUpdate(sender string, updates UpdateTime) (pending pendingUpdate, status ResponseStatus, content string) {
+	pending.UpdateTime = updates
+	var err error
+	switch updates.Code {
+	case CodeRegister, CodeDrop:
+		err = json.Unmarshal([]byte(updates.Content), &pending.node)
+		if err == nil && pending.node.Oauth.UserName == "" {
+			// nodes running an earlier version send the whole list of online nodes
+			if json.Unmarshal([]byte(updates.Content), &pending.nodes) == nil && pending.nodes.NodesList != nil {
+				pending.Code = CodeNodes
+				break
+			}
+			err = errors.New("missing user name")
+		}
+
+	case CodeNodes:
+		err = json.Unmarshal([]byte(updates.Content), &pending.nodes)
+		if err == nil && pending.nodes.NodesList == nil {
+			pending.nodes.NodesList = map[string]Node{}
 		}
-		node.setOnlineNodes(nodes)
 
 	case CodeDirectory:
-		var dir Directory
-		err := json.Unmarshal([]byte(updateContent.Content), &dir)
-		if err != nil {
-			log.Printf("(HandleCodeUpdate) unmarshalling Directory failed%q\n", err)
+		err = json.Unmarshal([]byte(updates.Content), &pending.dir)
+
+	case CodeCreateFile, CodeUpdateFile, CodeDeleteFile, CodeCreateDir, CodeDeleteDir:
+		if err = json.Unmarshal([]byte(updates.Content), &pending.file); err != nil {
 			break
 		}
-		node.setDir(dir)
+		pending.name, err = ParseFileName(pending.file.Name)
+		if err != nil || string(pending.name) != pending.file.Name {
+			return pending, StatusBadFileName, pending.file.Name
+		}
 
-	case CodeCreateFile, CodeUpdateFile, CodeDeleteFile:
-		var fileExternal File
-		err := json.Unmarshal([]byte(updateContent.Content), &fileExternal)
-		if err != nil {
-			log.Printf("(HandleCodeUpdate) unmarshalling Directory failed%q\n", err)
+	case CodeRenameDir:
+		if err = json.Unmarshal([]byte(updates.Content), &pending.rename); err != nil {
 			break
 		}
+		if pending.name, err = ParseFileName(pending.rename.Name); err != nil {
+			return pending, StatusBadFileName, pending.rename.Name
+		}
+		if pending.to, err = ParseFileName(pending.rename.NewName); err != nil {
+			return pending, StatusBadFileName, pending.rename.NewName
+		}
 
-		fileInternal, ok := node.getFile(fileExternal.Name)
-		if updateContent.Code == CodeDeleteFile {
-			if !ok {
-				return responseFormat(node, mssg, StatusFileNotFound, true, fileInternal.Name)
-			}
-			if fileInternal.CreatedAt.After(fileExternal.RecentUpdate.At) {
-				return responseFormat(node, mssg, StatusFileUpdateOld, true, fileInternal.Name)
-			}
-			node.deleteFile(fileInternal.Name, fileInternal.RecentUpdate)
+	case CodeNeighbours:
+		// a node only publishes its own links
+		if updates.By != sender {
+			return pending, StatusNotOauth, ""
+		}
+		err = json.Unmarshal([]byte(updates.Content), &pending.neighbours)
+
+	default:
+		return pending, StatusBadFormat, ""
+	}
+	if err != nil {
+		log.Printf("(decodeUpdate) unmarshalling %s failed %q\n", updates.Code, err)
+		return pending, StatusBadFormat, err.Error()
+	}
+	return pending, StatusOk, ""
+}
+
+// applyUpdate applies an update decoded by decodeUpdate, node.updateMx must be held
+func (node *NodeConfig) applyUpdate(pending pendingUpdate) (ResponseStatus, string) {
+	recent := pending.UpdateTime
+	recent.Content = ""
+
+	switch pending.Code {
+	case CodeRegister:
+		node.createNode(pending.node, recent)
 
-		} else if updateContent.Code == CodeCreateFile {
-			if ok && fileInternal.CreatedAt.Before(fileExternal.CreatedAt) {
-				return responseFormat(node, mssg, StatusFileExist, true, fileInternal.Name)
+	case CodeDrop:
+		node.deleteNode(pending.node.Oauth.UserName, recent)
+
+	case CodeNodes:
+		node.setOnlineNodes(pending.nodes)
+		// the sender may not know the current mesh initiator yet
+		node.SetMeshInitiator(node.meshInitiator())
+
+	case CodeDirectory:
+		node.setDir(pending.dir)
+
+	case CodeCreateFile, CodeUpdateFile, CodeDeleteFile, CodeCreateDir, CodeDeleteDir:
+		fileExternal := pending.file
+		node.observe(fileExternal.RecentUpdate.Clock)
+		fileInternal, ok := node.getFile(fileExternal.Name)
+		if !ok {
+			if pending.Code != CodeCreateFile && pending.Code != CodeCreateDir {
+				return StatusFileNotFound, fileExternal.Name
 			}
-			// File did not exist or fileExternal was created before fileInternal
 			node.createFile(fileExternal)
-		} else {
-			if !ok {
-				return responseFormat(node, mssg, StatusFileNotFound, true, fileInternal.Name)
+			break
+		}
+
+		// the version vectors tell which change saw the other, concurrent changes are kept as conflicts
+		kept, remote, status := node.resolveFile(fileInternal, fileExternal)
+		if !remote {
+			if status == StatusFileConflict {
+				// the merged version vector
+				node.createFile(kept)
 			}
-			if fileInternal.RecentUpdate.At.After(fileExternal.RecentUpdate.At) {
-				return responseFormat(node, mssg, StatusFileUpdateOld, true, fileExternal.Name)
+			return status, fileExternal.Name
+		}
+		if pending.Code == CodeDeleteFile || pending.Code == CodeDeleteDir {
+			// the directory records the remote delete, not the last local change of the file
+			node.writeMx.Lock()
+			node.deleteFile(fileInternal.Name, recent)
+			deleteReplica(node, fileInternal)
+			if fileInternal.IsDir {
+				if err := deleteDir(node, pending.name); err != nil {
+					log.Printf("(applyUpdate) deleting local directory %q failed %q\n", fileInternal.Name, err)
+				}
 			}
-			node.createFile(fileExternal)
+			node.writeMx.Unlock()
+		} else {
+			node.createFile(kept)
+		}
+		if status != StatusOk {
+			return status, fileExternal.Name
 		}
 
-	default:
-		return responseFormat(node, mssg, StatusBadFormat, true, "")
-	}
+	case CodeRenameDir:
+		node.observe(pending.Clock)
+		if status := applyRenameDir(node, pending.name, pending.to, pending.UpdateTime); status != StatusOk {
+			return status, pending.rename.Name
+		}
 
-	return responseFormat(node, mssg, StatusOk, true, "")
+	case CodeNeighbours:
+		node.setLinks(pending.UpdateTime, pending.neighbours)
+	}
+	return StatusOk, ""
 }
 
 func (node *NodeConfig) HandleCodePing(mssg *Message) *Message {
@@ -0,0 +1,83 @@
+package node
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestApplyUpdateDelete(t *testing.T) {
+	n := newStreamTestNode(t, nil)
+	f := File{
+		Owner:        "peer",
+		Name:         "remote.txt",
+		CreatedAt:    time.Now().Add(-time.Hour),
+		Creator:      "peer",
+		Versions:     map[string]uint64{"peer": 1},
+		RecentUpdate: UpdateTime{At: time.Now().Add(-time.Hour), By: "peer", Code: CodeCreateFile},
+	}
+	n.createFile(f)
+
+	deleted := f
+	deleted.Versions = map[string]uint64{"peer": 2}
+	deleted.RecentUpdate = UpdateTime{At: time.Now(), By: "peer", Code: CodeDeleteFile, Clock: HLC{Wall: time.Now().UnixNano(), Node: "peer"}}
+	content, _ := json.Marshal(&deleted)
+	update := deleted.RecentUpdate
+	update.Content = string(content)
+
+	pending, status, _ := decodeUpdate("peer", update)
+	if status != StatusOk {
+		t.Fatal(status)
+	}
+	if status, _ = n.applyUpdate(pending); status != StatusOk {
+		t.Fatal(status)
+	}
+	if _, ok := n.getFile(f.Name); ok {
+		t.Fatal("file not deleted")
+	}
+	recent := n.Record.Directory.RecentUpdate
+	if !recent.At.Equal(update.At) || recent.Clock != update.Clock || recent.Code != CodeDeleteFile {
+		t.Fatalf("directory updated with %+v instead of the delete", recent)
+	}
+}
+
+func TestRenameDirVersions(t *testing.T) {
+	n := newStreamTestNode(t, nil)
+	if m := n.ClientCreateDir("a"); m.Status != StatusOk {
+		t.Fatal(m.Status)
+	}
+	if m := n.ClientCreateFile("a/x.txt"); m.Status != StatusOk {
+		t.Fatal(m.Status)
+	}
+	before, _ := n.getFile("a/x.txt")
+
+	if m := n.ClientRenameDir("a", "b"); m.Status != StatusOk {
+		t.Fatal(m.Status)
+	}
+	local, _ := n.getFile("b/x.txt")
+	if local.Versions["stream"] != before.Versions["stream"]+1 || compareVersions(before, local) != versionBefore {
+		t.Fatalf("versions %v after a rename of %v", local.Versions, before.Versions)
+	}
+	if local.RecentUpdate.Clock.Wall == 0 || local.RecentUpdate.Code != CodeRenameDir {
+		t.Fatalf("moved file has update %+v", local.RecentUpdate)
+	}
+
+	// a rename made by another node bumps its entry, with its clock
+	content, _ := json.Marshal(&RenameDirContent{Name: "b", NewName: "c"})
+	update := UpdateTime{At: time.Now(), By: "peer", Code: CodeRenameDir, Content: string(content)}
+	update.Clock = HLC{Wall: time.Now().UnixNano(), Node: "peer"}
+	pending, status, _ := decodeUpdate("peer", update)
+	if status != StatusOk {
+		t.Fatal(status)
+	}
+	if status, _ = n.applyUpdate(pending); status != StatusOk {
+		t.Fatal(status)
+	}
+	remote, _ := n.getFile("c/x.txt")
+	if remote.Versions["peer"] != 1 || remote.Versions["stream"] != local.Versions["stream"] {
+		t.Fatalf("versions %v after a remote rename of %v", remote.Versions, local.Versions)
+	}
+	if remote.RecentUpdate.Clock != update.Clock {
+		t.Fatalf("moved file has clock %+v instead of %+v", remote.RecentUpdate.Clock, update.Clock)
+	}
+}
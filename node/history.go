@@ -0,0 +1,446 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// THE OWNER KEEPS THE LAST MaxVersions CONTENTS OF EVERY FILE
+//
+// File.Revision is bumped by every write. Before a write replaces the content, the previous content is saved
+// under the state store with the record of its revision. Versions can be listed, read, compared and restored,
+// a restore is a new write so it can be undone too. A transferred file takes its history to its new owner.
+
+const (
+	versionsDirName = "versions"
+	// diffs of longer files are refused, the comparison needs about lines(a)*lines(b) steps once the common first
+	// and last lines are left out. Memory only grows with the number of lines
+	maxDiffCells = 1 << 24
+)
+
+// used internally
+type VersionContent struct {
+	Name     string `json:"name"`
+	Revision uint64 `json:"revision"`
+	// the other revision of CodeDiffVersions
+	To       uint64 `json:"to,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// FileVersion describes a saved version of a file
+type FileVersion struct {
+	Revision     uint64     `json:"revision"`
+	RecentUpdate UpdateTime `json:"recent_update"`
+	Size         int64      `json:"size"`
+	Current      bool       `json:"current,omitempty"`
+}
+
+func (node *NodeConfig) ClientVersions(fileName string) *MessageBody {
+	return node.versionRequest(CodeListVersions, VersionContent{Name: fileName})
+}
+
+func (node *NodeConfig) ClientReadVersion(fileName string, revision uint64, encoding string) *MessageBody {
+	return node.versionRequest(CodeReadVersion, VersionContent{Name: fileName, Revision: revision, Encoding: encoding})
+}
+
+// ClientDiffVersions returns the lines that changed from revision to revision to, "-" removed and "+" added
+func (node *NodeConfig) ClientDiffVersions(fileName string, revision, to uint64) *MessageBody {
+	return node.versionRequest(CodeDiffVersions, VersionContent{Name: fileName, Revision: revision, To: to})
+}
+
+func (node *NodeConfig) ClientRestoreVersion(fileName string, revision uint64) *MessageBody {
+	return node.versionRequest(CodeRestoreVersion, VersionContent{Name: fileName, Revision: revision})
+}
+
+// versionRequest sends a request about the history of a file to its owner
+func (node *NodeConfig) versionRequest(code Code, content VersionContent) *MessageBody {
+	name, err := ParseFileName(content.Name)
+	if err != nil {
+		return messageBodyFormat(code, StatusBadFileName, content.Name)
+	}
+	content.Name = string(name)
+	f, ok := node.getFile(content.Name)
+	if !ok {
+		return messageBodyFormat(code, StatusFileNotFound, content.Name)
+	}
+	if f.IsDir {
+		return messageBodyFormat(code, StatusIsDir, content.Name)
+	}
+	remoteNode, ok := node.getNode(f.Owner)
+	if !ok {
+		return messageBodyFormat(code, StatusNodeNotOnline, f.Owner)
+	}
+
+	contentRaw, _ := json.Marshal(&content)
+	reqMssg := Message{
+		Header: MessageHeader{
+			Node:        node.Node,
+			Destination: f.Owner,
+		},
+		Body: *messageBodyFormat(code, "", string(contentRaw)),
+	}
+
+	if f.Owner == node.Node.Oauth.UserName {
+		return &node.Handle(&reqMssg).Body
+	}
+
+	resMssg, err := node.send(context.Background(), remoteNode.Address, &reqMssg)
+	if err != nil {
+		log.Printf("(versionRequest) network error: %q\n", err)
+		return messageBodyFormat(code, StatusInternalError, err.Error())
+	}
+	return &resMssg.Body
+}
+
+func (node *NodeConfig) HandleCodeListVersions(mssg *Message) *Message {
+	var content VersionContent
+	if err := json.Unmarshal([]byte(mssg.Body.Content), &content); err != nil {
+		return responseFormat(node, mssg, StatusBadFormat, true, err.Error())
+	}
+	name, f, status := node.ownedFile(content.Name)
+	if status != StatusOk {
+		return responseFormat(node, mssg, status, true, "")
+	}
+
+	versions := savedVersions(node, f)
+	current := FileVersion{Revision: f.Revision, RecentUpdate: f.RecentUpdate, Current: true}
+	if info, err := node.Storage.Stat(name); err == nil {
+		current.Size = info.Size
+	}
+	versions = append(versions, current)
+	resBody, _ := json.Marshal(versions)
+	return responseFormat(node, mssg, StatusOk, true, string(resBody))
+}
+
+func (node *NodeConfig) HandleCodeReadVersion(mssg *Message) *Message {
+	var content VersionContent
+	if err := json.Unmarshal([]byte(mssg.Body.Content), &content); err != nil {
+		return responseFormat(node, mssg, StatusBadFormat, true, err.Error())
+	}
+	name, f, status := node.ownedFile(content.Name)
+	if status != StatusOk {
+		return responseFormat(node, mssg, status, true, "")
+	}
+	data, status := readVersion(node, name, f, content.Revision)
+	if status != StatusOk {
+		return responseFormat(node, mssg, status, true, "")
+	}
+	encoded, err := encodeContent(content.Encoding, data)
+	if err != nil {
+		return responseFormat(node, mssg, StatusBadFormat, true, err.Error())
+	}
+	return responseFormat(node, mssg, StatusOk, true, encoded)
+}
+
+func (node *NodeConfig) HandleCodeDiffVersions(mssg *Message) *Message {
+	var content VersionContent
+	if err := json.Unmarshal([]byte(mssg.Body.Content), &content); err != nil {
+		return responseFormat(node, mssg, StatusBadFormat, true, err.Error())
+	}
+	name, f, status := node.ownedFile(content.Name)
+	if status != StatusOk {
+		return responseFormat(node, mssg, status, true, "")
+	}
+	from, status := readVersion(node, name, f, content.Revision)
+	if status != StatusOk {
+		return responseFormat(node, mssg, status, true, strconv.FormatUint(content.Revision, 10))
+	}
+	to, status := readVersion(node, name, f, content.To)
+	if status != StatusOk {
+		return responseFormat(node, mssg, status, true, strconv.FormatUint(content.To, 10))
+	}
+
+	diff, ok := diffLines(string(from), string(to))
+	if !ok {
+		return responseFormat(node, mssg, StatusBadFormat, true, "files are too large to compare")
+	}
+	return responseFormat(node, mssg, StatusOk, true, diff)
+}
+
+func (node *NodeConfig) HandleCodeRestoreVersion(mssg *Message) *Message {
+	var content VersionContent
+	if err := json.Unmarshal([]byte(mssg.Body.Content), &content); err != nil {
+		return responseFormat(node, mssg, StatusBadFormat, true, err.Error())
+	}
+	node.writeMx.Lock()
+	defer node.writeMx.Unlock()
+	name, f, status := node.ownedFile(content.Name)
+	if status != StatusOk {
+		return responseFormat(node, mssg, status, true, "")
+	}
+	data, status := readVersion(node, name, f, content.Revision)
+	if status != StatusOk {
+		return responseFormat(node, mssg, status, true, "")
+	}
+
+	saveVersion(node, name, f)
+	if err := writeFile(node, name, data); err != nil {
+		log.Printf("(HandleCodeRestoreVersion) write file error %q\n", err)
+		return responseFormat(node, mssg, StatusInternalError, true, err.Error())
+	}
+	f = node.ownedFileWritten(f, mssg.Header.Node.Oauth.UserName)
+	return responseFormat(node, mssg, StatusOk, true, strconv.FormatUint(f.Revision, 10))
+}
+
+// versionsDir is the history of f, it doesn't depend on the name so renaming a directory keeps it
+func versionsDir(node *NodeConfig, f File) string {
+	return filepath.Join(stateDir(node), versionsDirName, fileKey(f))
+}
+
+// saveVersion keeps the current content of an owned file before it is replaced
+func saveVersion(node *NodeConfig, name FileName, f File) {
+	if node.MaxVersions <= 0 {
+		return
+	}
+	src, err := node.Storage.Read(name, 0, 0)
+	if err != nil {
+		log.Printf("(saveVersion) error: %q\n", err)
+		return
+	}
+	defer src.Close()
+
+	dir := versionsDir(node, f)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		log.Printf("(saveVersion) error: %q\n", err)
+		return
+	}
+	rev := strconv.FormatUint(f.Revision, 10)
+	dst, err := os.Create(filepath.Join(dir, rev))
+	if err != nil {
+		log.Printf("(saveVersion) error: %q\n", err)
+		return
+	}
+	_, err = io.Copy(dst, src)
+	if e := dst.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		fileJson, _ := json.Marshal(&f)
+		err = os.WriteFile(filepath.Join(dir, rev+".json"), fileJson, 0666)
+	}
+	if err != nil {
+		log.Printf("(saveVersion) saving revision %s of %q failed: %q\n", rev, f.Name, err)
+		os.Remove(filepath.Join(dir, rev))
+		return
+	}
+
+	versions := savedVersions(node, f)
+	for i := 0; i < len(versions)-node.MaxVersions; i++ {
+		old := strconv.FormatUint(versions[i].Revision, 10)
+		os.Remove(filepath.Join(dir, old))
+		os.Remove(filepath.Join(dir, old+".json"))
+	}
+}
+
+// savedVersions lists the saved versions of f, the oldest first
+func savedVersions(node *NodeConfig, f File) []FileVersion {
+	dir := versionsDir(node, f)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return []FileVersion{}
+	}
+	versions := []FileVersion{}
+	for _, entry := range entries {
+		rev, err := strconv.ParseUint(entry.Name(), 10, 64)
+		if err != nil {
+			continue
+		}
+		v := FileVersion{Revision: rev}
+		if info, err := entry.Info(); err == nil {
+			v.Size = info.Size()
+		}
+		var saved File
+		if raw, err := os.ReadFile(filepath.Join(dir, entry.Name()+".json")); err == nil && json.Unmarshal(raw, &saved) == nil {
+			v.RecentUpdate = saved.RecentUpdate
+		}
+		versions = append(versions, v)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Revision < versions[j].Revision })
+	return versions
+}
+
+func readVersion(node *NodeConfig, name FileName, f File, revision uint64) ([]byte, ResponseStatus) {
+	var data []byte
+	var err error
+	if revision == f.Revision {
+		var r io.ReadCloser
+		if r, err = node.Storage.Read(name, 0, 0); err == nil {
+			data, err = io.ReadAll(r)
+			r.Close()
+		}
+	} else {
+		data, err = os.ReadFile(filepath.Join(versionsDir(node, f), strconv.FormatUint(revision, 10)))
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, StatusFileNotFound
+	}
+	if err != nil {
+		log.Printf("(readVersion) error: %q\n", err)
+		return nil, StatusInternalError
+	}
+	return data, StatusOk
+}
+
+func deleteVersions(node *NodeConfig, f File) {
+	if err := os.RemoveAll(versionsDir(node, f)); err != nil {
+		log.Printf("(deleteVersions) error: %q\n", err)
+	}
+}
+
+// diffLines compares a and b line by line with their longest common subsequence(Hirschberg's algorithm, in linear space).
+// Lines of a only start with "-", lines of b only with "+" and common lines with a space
+func diffLines(a, b string) (string, bool) {
+	linesA, linesB := splitLines(a), splitLines(b)
+	// lines are compared by id
+	ids := map[string]int{}
+	lineIDs := func(lines []string) []int {
+		line := make([]int, len(lines))
+		for i, l := range lines {
+			id, ok := ids[l]
+			if !ok {
+				id = len(ids)
+				ids[l] = id
+			}
+			line[i] = id
+		}
+		return line
+	}
+	d := lineDiff{linesA: linesA, linesB: linesB, a: lineIDs(linesA), b: lineIDs(linesB)}
+
+	n, m := len(d.a), len(d.b)
+	prefix := 0
+	for prefix < n && prefix < m && d.a[prefix] == d.b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < n-prefix && suffix < m-prefix && d.a[n-1-suffix] == d.b[m-1-suffix] {
+		suffix++
+	}
+	if (n-prefix-suffix)*(m-prefix-suffix) > maxDiffCells {
+		return "", false
+	}
+	d.diff(0, n, 0, m)
+	return d.out.String(), true
+}
+
+type lineDiff struct {
+	linesA, linesB []string
+	// ids of the lines
+	a, b []int
+	out  strings.Builder
+}
+
+// diff writes the lines from a[a0:a1] to b[b0:b1]
+func (d *lineDiff) diff(a0, a1, b0, b1 int) {
+	for a0 < a1 && b0 < b1 && d.a[a0] == d.b[b0] {
+		d.out.WriteString("  " + d.linesA[a0] + "\n")
+		a0++
+		b0++
+	}
+	suffix := 0
+	for a1 > a0 && b1 > b0 && d.a[a1-1] == d.b[b1-1] {
+		a1--
+		b1--
+		suffix++
+	}
+
+	switch {
+	case a0 == a1 || b0 == b1:
+		d.removed(a0, a1)
+		d.added(b0, b1)
+	case a1-a0 == 1:
+		j := b0
+		for j < b1 && d.b[j] != d.a[a0] {
+			j++
+		}
+		if j == b1 {
+			d.removed(a0, a1)
+			d.added(b0, b1)
+			break
+		}
+		d.added(b0, j)
+		d.out.WriteString("  " + d.linesA[a0] + "\n")
+		d.added(j+1, b1)
+	default:
+		// b is split where the best common subsequences of both halves of a meet
+		mid := (a0 + a1) / 2
+		forward := lcsForward(d.a[a0:mid], d.b[b0:b1])
+		backward := lcsBackward(d.a[mid:a1], d.b[b0:b1])
+		split := 0
+		for k := range forward {
+			if forward[k]+backward[k] > forward[split]+backward[split] {
+				split = k
+			}
+		}
+		d.diff(a0, mid, b0, b0+split)
+		d.diff(mid, a1, b0+split, b1)
+	}
+
+	for i := a1; i < a1+suffix; i++ {
+		d.out.WriteString("  " + d.linesA[i] + "\n")
+	}
+}
+
+func (d *lineDiff) removed(a0, a1 int) {
+	for i := a0; i < a1; i++ {
+		d.out.WriteString("- " + d.linesA[i] + "\n")
+	}
+}
+
+func (d *lineDiff) added(b0, b1 int) {
+	for j := b0; j < b1; j++ {
+		d.out.WriteString("+ " + d.linesB[j] + "\n")
+	}
+}
+
+// lcsForward returns the length of the longest common subsequence of a and b[:k] for every k
+func lcsForward(a, b []int) []int {
+	prev, cur := make([]int, len(b)+1), make([]int, len(b)+1)
+	for i := range a {
+		for j := range b {
+			if a[i] == b[j] {
+				cur[j+1] = prev[j] + 1
+			} else if prev[j+1] >= cur[j] {
+				cur[j+1] = prev[j+1]
+			} else {
+				cur[j+1] = cur[j]
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev
+}
+
+// lcsBackward returns the length of the longest common subsequence of a and b[k:] for every k
+func lcsBackward(a, b []int) []int {
+	prev, cur := make([]int, len(b)+1), make([]int, len(b)+1)
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				cur[j] = prev[j+1] + 1
+			} else if prev[j] >= cur[j+1] {
+				cur[j] = prev[j]
+			} else {
+				cur[j] = cur[j+1]
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
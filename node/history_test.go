@@ -0,0 +1,72 @@
+package node
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestDiffLines(t *testing.T) {
+	// lines that are all different, too many for maxDiffCells
+	distinct := func(prefix string, n int) string {
+		var s strings.Builder
+		for i := 0; i < n; i++ {
+			s.WriteString(prefix + strconv.Itoa(i) + "\n")
+		}
+		return s.String()
+	}
+	cases := []struct {
+		name string
+		a, b string
+		// common lines of the script, the length of the longest common subsequence
+		common int
+		ok     bool
+	}{
+		{"both empty", "", "", 0, true},
+		{"empty to non-empty", "", "a\nb\n", 0, true},
+		{"non-empty to empty", "a\nb\n", "", 0, true},
+		{"identical", "a\nb\nc\n", "a\nb\nc\n", 3, true},
+		{"middle change", "a\nb\nc\n", "a\nx\nc\n", 2, true},
+		{"prefix change", "x\nb\nc\n", "y\nb\nc\n", 2, true},
+		{"suffix change", "a\nb\nx\n", "a\nb\ny\n", 2, true},
+		{"one line found", "a\nb\nc\n", "a\nx\nb\ny\nc\n", 3, true},
+		{"one line not found", "a\nb\nc\n", "a\nx\ny\nc\n", 2, true},
+		{"no trailing newline", "a\nb", "a\nc", 1, true},
+		{"moved lines", "a\nb\nc\nd\ne\nf\n", "c\nd\na\nb\nf\ne\n", 3, true},
+		{"repeated lines", "a\nb\na\nb\na\n", "b\na\nb\nb\na\na\n", 4, true},
+		{"too large", distinct("a", 4097), distinct("b", 4097), 0, false},
+	}
+	for _, c := range cases {
+		script, ok := diffLines(c.a, c.b)
+		if ok != c.ok {
+			t.Errorf("%s: ok is %v", c.name, ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		var fromA, toB []string
+		common := 0
+		for _, line := range splitLines(script) {
+			switch {
+			case strings.HasPrefix(line, "  "):
+				fromA = append(fromA, line[2:])
+				toB = append(toB, line[2:])
+				common++
+			case strings.HasPrefix(line, "- "):
+				fromA = append(fromA, line[2:])
+			case strings.HasPrefix(line, "+ "):
+				toB = append(toB, line[2:])
+			default:
+				t.Fatalf("%s: bad line %q in %q", c.name, line, script)
+			}
+		}
+		if strings.Join(fromA, "\n") != strings.Join(splitLines(c.a), "\n") ||
+			strings.Join(toB, "\n") != strings.Join(splitLines(c.b), "\n") {
+			t.Errorf("%s: %q isn't an edit script from %q to %q", c.name, script, c.a, c.b)
+		}
+		if common != c.common {
+			t.Errorf("%s: %d common lines instead of %d in %q", c.name, common, c.common, script)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package node
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+)
+
+// METADATA OF FILE CONTENTS
+//
+// The owner computes the size, SHA-256, content type and modification time of a file every time it creates or
+// writes it, they are published with the file. Readers check the content they get against the SHA-256.
+
+// fileMetadata returns f with the metadata of its local content, f must be owned by this node
+func fileMetadata(node *NodeConfig, f File) File {
+	if f.IsDir {
+		return f
+	}
+	info, err := node.Storage.Stat(FileName(f.Name))
+	if err != nil {
+		log.Printf("(fileMetadata) error: %q\n", err)
+		return f
+	}
+	file, err := node.Storage.Read(FileName(f.Name), 0, 0)
+	if err != nil {
+		log.Printf("(fileMetadata) error: %q\n", err)
+		return f
+	}
+	defer file.Close()
+
+	// the first bytes are enough to detect the content type
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(file, head)
+	hash := sha256.New()
+	hash.Write(head[:n])
+	if _, err := io.Copy(hash, file); err != nil {
+		log.Printf("(fileMetadata) hashing %q failed: %q\n", f.Name, err)
+		return f
+	}
+
+	f.Size = info.Size
+	f.ModTime = info.ModTime
+	f.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	f.ContentType = mime.TypeByExtension(path.Ext(f.Name))
+	if f.ContentType == "" {
+		f.ContentType = http.DetectContentType(head[:n])
+	}
+	return f
+}
+
+// checksumMatches reports whether data is the content described by f, files published without checksum match anything
+func checksumMatches(f File, data []byte) bool {
+	if f.SHA256 == "" {
+		return true
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]) == f.SHA256
+}
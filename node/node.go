@@ -1,15 +1,17 @@
 package node
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"log"
-	"net"
 	"strings"
 )
 
 func (node *NodeConfig) Stop() {
 	close(node.stopNode)
+	closeStore(node)
+	closeOutbox(node)
 }
 
 func MustInitServer(temp NodeConfig, meshInitiator string, netClient NetClient) *NodeConfig {
@@ -25,23 +27,41 @@ func MustInitServer(temp NodeConfig, meshInitiator string, netClient NetClient)
 		log.Fatalf("Failed to initialize node: %q\n", err)
 	}
 
+	// a restarted node overrides whatever the mesh still remembers about it
+	newNode.gossipAlive()
+
 	// If node is a network inititator don't advertise on network
 	if meshInitiator != "" {
-		err = advertiseOnNetwork(&newNode, meshInitiator)
+		// any node of the mesh can register new nodes, try them in order
+		for _, initiator := range strings.Split(meshInitiator, ",") {
+			err = advertiseOnNetwork(&newNode, strings.TrimSpace(initiator))
+			if err == nil {
+				break
+			}
+		}
 		if err != nil {
 			log.Fatalf("Failed to advertise node on network: %q\n", err)
 		}
 	} else {
+		newNode.SetMeshInitiator(Node{})
 		log.Printf("Node(%s) is mesh initiator %q\n", newNode.Node.Oauth.UserName, newNode.Node.Address)
 	}
 
+	loadOutboxes(&newNode)
 	err = addOwnedFiles(&newNode)
 	if err != nil {
 		log.Println("WalkDir failed with ", err)
 	}
 
-	go nodeDequeUpdates(&newNode)
 	go nodePing(&newNode)
+	go nodePersist(&newNode)
+	go nodeReplicate(&newNode)
+	go nodeAntiEntropy(&newNode)
+	go nodeWatch(&newNode)
+	go nodeUploads(&newNode)
+	if newNode.MaxNeighbours > 0 {
+		go nodeNeighbours(&newNode)
+	}
 	return &newNode
 }
 
@@ -51,12 +71,48 @@ func initializeNode(node *NodeConfig) error {
 		return err
 	}
 
+	id, saved, err := loadIdentity(node)
+	if err != nil {
+		return err
+	}
+	state, ok, err := loadState(node)
+	if err != nil {
+		return err
+	}
+	if !saved && ok && len(state.PrivateKey) != 0 {
+		// a store written before the identity file
+		id, saved = nodeIdentity{UserName: state.Node.Oauth.UserName, PrivateKey: state.PrivateKey}, true
+	}
+	// keep the identity of the node so it still owns its files
+	if saved && (node.Node.Oauth.UserName == "" || node.Node.Oauth.UserName == id.UserName) {
+		node.Node.Oauth.UserName = id.UserName
+		node.privateKey = id.PrivateKey
+	}
+	if ok {
+		log.Printf("Recovered %d files and %d nodes from the state store\n", len(state.Record.Directory.FilesList), len(state.Record.OnlineNodes.NodesList))
+		node.Record = state.Record
+		node.tombstones = state.Tombstones
+		pruneTombstones(node)
+	}
+
 	if node.Node.Oauth.UserName == "" {
 		node.Node.Oauth.UserName = randomText()
 	}
-	if node.Node.Oauth.Password == "" {
-		node.Node.Oauth.Password = randomText()
+	if len(node.privateKey) == 0 {
+		if node.privateKey, err = generateKey(); err != nil {
+			return err
+		}
 	}
+	if !saved || id.UserName != node.Node.Oauth.UserName || !id.PrivateKey.Equal(node.privateKey) {
+		err = saveIdentity(node, nodeIdentity{UserName: node.Node.Oauth.UserName, PrivateKey: node.privateKey})
+		if err != nil {
+			return err
+		}
+	}
+	if err := openStore(node); err != nil {
+		return err
+	}
+	node.Node.PublicKey = encodePublicKey(node.privateKey)
 
 	if node.PublicAddr == nil {
 		return errors.New("public address is required")
@@ -84,7 +140,7 @@ func advertiseOnNetwork(node *NodeConfig, initiator string) error {
 		},
 	}
 
-	resBody, err := node.NetClient(initiator, &message)
+	resBody, err := node.send(context.Background(), initiator, &message)
 	if err != nil {
 		log.Printf("Failed to dial mesh initiator message")
 		return err
@@ -100,45 +156,67 @@ func advertiseOnNetwork(node *NodeConfig, initiator string) error {
 		log.Printf("Failed to unmarshall mesh initiator record")
 		return err
 	}
-	node.Record = record
-	node.SetMeshInitiator(resBody.Header.Node)
-	return nil
-}
+	reconcileRecord(node, record)
 
-func nodeDequeUpdates(node *NodeConfig) {
-	for {
-		select {
-		case updates := <-node.updatesChan:
-			sendUpdates(node, updates)
-		case <-node.stopNode:
-			return
-		}
+	// the node we registered through may not be the mesh initiator
+	meshInitiator := resBody.Header.Node
+	if n, ok := record.OnlineNodes.NodesList[record.OnlineNodes.Initiator]; ok {
+		meshInitiator = n
 	}
+	node.SetMeshInitiator(meshInitiator)
+	return nil
 }
 
+// sendUpdates sends updates to every peer once without queueing them, see queueUpdate
 func sendUpdates(node *NodeConfig, updates *UpdateTime) {
 	log.Printf("Sending new updates(%s)\n", updates.Code)
-	for _, _node := range copyNodesAddress(node) {
-		updateTimeRaw, _ := json.Marshal(updates)
-		mssg := Message{
-			Header: MessageHeader{
-				Node: node.Node,
-			},
-			Body: MessageBody{
-				Code:    CodeUpdate,
-				Content: string(updateTimeRaw),
-			},
-		}
-		resMssg, err := node.NetClient(_node.Address, &mssg)
-		if err != nil {
-			log.Printf("(sendUpdates) dialing node(%s) error: %q\n", _node.Oauth.UserName, err)
+	updateTimeRaw, _ := json.Marshal(updates)
+	mssg := Message{
+		Header: MessageHeader{
+			Node: node.Node,
+		},
+		Body: MessageBody{
+			Code:    CodeUpdate,
+			Content: string(updateTimeRaw),
+		},
+	}
+	peers := copyNodesAddress(node)
+	reached := 0
+	for _, res := range node.fanOut(context.Background(), peers, &mssg, 0, nil) {
+		if res.Err != nil {
+			log.Printf("(sendUpdates) dialing node(%s) error: %q\n", res.Node.Oauth.UserName, res.Err)
 			continue
 		}
-
-		if resMssg.Body.Status != StatusOk {
-			log.Printf("Node(%s) update code(%s) responded with %q\n", _node.Oauth.UserName, resMssg.Body.Code, resMssg.Body.Status)
+		reached++
+		if res.Response.Body.Status != StatusOk {
+			log.Printf("Node(%s) update code(%s) responded with %q\n", res.Node.Oauth.UserName, res.Response.Body.Code, res.Response.Body.Status)
 		}
 	}
+	log.Printf("(sendUpdates) %d of %d nodes reached\n", reached, len(peers))
+}
+
+// sendUpdate returns an error if _node could not be reached, its answer is only logged
+func sendUpdate(node *NodeConfig, _node Node, updates *UpdateTime) error {
+	updateTimeRaw, _ := json.Marshal(updates)
+	mssg := Message{
+		Header: MessageHeader{
+			Node:        node.Node,
+			Destination: _node.Oauth.UserName,
+		},
+		Body: MessageBody{
+			Code:    CodeUpdate,
+			Content: string(updateTimeRaw),
+		},
+	}
+	resMssg, err := node.send(context.Background(), _node.Address, &mssg)
+	if err != nil {
+		return err
+	}
+
+	if resMssg.Body.Status != StatusOk {
+		log.Printf("Node(%s) update code(%s) responded with %q\n", _node.Oauth.UserName, resMssg.Body.Code, resMssg.Body.Status)
+	}
+	return nil
 }
 
 func copyNodesAddress(node *NodeConfig) []Node {
@@ -159,33 +237,12 @@ func copyNodesAddress(node *NodeConfig) []Node {
 }
 
 func nodePing(node *NodeConfig) {
-	if node.meshInitiator().Address != "" {
-		// ONLY MESH INITIATOR CAN SEND PINGS TO OTHER NODES
-		return
-	}
 	for {
 		select {
-		case <-node.initiatorPing.C:
-			mssg := Message{
-				Header: MessageHeader{
-					Node: node.Node,
-				},
-				Body: MessageBody{
-					Code: CodePing,
-				},
-			}
-			for _, _node := range copyNodesAddress(node) {
-				resMssg, err := node.NetClient(_node.Address, &mssg)
-				if e, ok := checkCantReachAddrError(err); ok {
-					// NODE COULD NOT BE REACHED
-					log.Printf("(nodePing) node(%s) could not be reached at(%s)\nError: %q\n", _node.Oauth.UserName, _node.Address, e)
-					removeNodes(node, _node)
-				}
-
-				if resMssg.Body.Status != StatusOk {
-					log.Printf("(nodePing) unexpected response status %q from %q\n", resMssg.Body.Status, _node.Oauth.UserName)
-				}
-			}
+		case <-node.probeTicker.C:
+			// EVERY NODE PROBES A RANDOM PEER, A SLOW PEER ONLY DELAYS ITS OWN PROBE
+			go probeRandomNode(node)
+			confirmSuspects(node)
 
 		case <-node.stopNode:
 			return
@@ -193,28 +250,7 @@ func nodePing(node *NodeConfig) {
 	}
 }
 
-func checkCantReachAddrError(err error) (error, bool) {
-	// FOR NOW TO KNOW IF THE NODE IS NOT ONLINE WE CHECK
-	if err == nil {
-		return nil, false
-	}
-	switch e := err.(type) {
-	case *net.ParseError, *net.AddrError, net.UnknownNetworkError, net.InvalidAddrError:
-		return e, true
-	case *net.DNSError:
-		if e.IsNotFound {
-			return e, true
-		}
-	}
-	if strings.Contains(err.Error(), "connection refused") {
-		return err, true
-	}
-	return err, false
-}
-
 func removeNodes(node *NodeConfig, n Node) {
 	node.deleteNode(n.Oauth.UserName, updateTimeNow(CodeNodes, node.Node.Oauth.UserName, ""))
-	nodesJson, _ := node.marshalJSONNodes()
-	now := updateTimeNow(CodeDrop, node.Node.Oauth.UserName, string(nodesJson))
-	node.updatesChan <- &now
+	node.queueUpdate(nodesDelta(CodeDrop, node.Node.Oauth.UserName, n))
 }
@@ -1,9 +1,13 @@
 package node
 
 import (
+	"context"
+	"crypto/ed25519"
 	"encoding/json"
 	"log"
 	"net"
+	"os"
+	"strings"
 	"sync"
 	"time"
 )
@@ -16,6 +20,8 @@ type Record struct {
 type OnlineNodes struct {
 	NodesList    map[string]Node `json:"nodes_list"`
 	RecentUpdate UpdateTime      `json:"recent_update"`
+	// username of the current mesh initiator
+	Initiator string `json:"initiator,omitempty"`
 }
 
 type Directory struct {
@@ -31,11 +37,14 @@ type Message struct {
 type Node struct {
 	Address string `json:"address"`
 	Oauth   Oauth  `json:"oauth"`
+	// base64 Ed25519 public key, messages of the node are signed with its private key
+	PublicKey string `json:"public_key"`
+	// SHA-256 of the TLS certificate of the node, if the transport uses one
+	CertFingerprint string `json:"cert_fingerprint,omitempty"`
 }
 
 type Oauth struct {
 	UserName string `json:"user_name"`
-	Password string `json:"password"`
 }
 
 type UpdateTime struct {
@@ -43,6 +52,8 @@ type UpdateTime struct {
 	By      string    `json:"by"`
 	Content string    `json:"content"`
 	Code    Code      `json:"code"`
+	// orders changes of files, At is only informative
+	Clock HLC `json:"clock"`
 }
 
 type File struct {
@@ -50,11 +61,34 @@ type File struct {
 	Name         string     `json:"name"`
 	CreatedAt    time.Time  `json:"created_at"`
 	RecentUpdate UpdateTime `json:"recent_update"`
+	IsDir        bool       `json:"is_dir,omitempty"`
+	// node that created the file, it doesn't change when the file is transferred
+	Creator string `json:"creator,omitempty"`
+	// usernames of the nodes holding a copy of the file
+	Replicas []string `json:"replicas,omitempty"`
+	// version vector, the number of changes published by each node
+	Versions map[string]uint64 `json:"versions,omitempty"`
+	// bumped by every write of the content, past revisions are kept by the owner
+	Revision uint64 `json:"revision,omitempty"`
+	// metadata of the content computed by the owner
+	Size        int64     `json:"size,omitempty"`
+	SHA256      string    `json:"sha256,omitempty"`
+	ContentType string    `json:"content_type,omitempty"`
+	ModTime     time.Time `json:"mod_time"`
 }
 
 type MessageHeader struct {
-	Node        Node   `json:"oauth"`
-	Destination string `json:"destination"`
+	Node        Node      `json:"oauth"`
+	Destination string    `json:"destination"`
+	Timestamp   time.Time `json:"timestamp"`
+	Nonce       string    `json:"nonce"`
+	// membership updates piggybacked on the message
+	Gossip []MemberUpdate `json:"gossip,omitempty"`
+	// hops left and nodes that forwarded the message to Destination, they are not signed
+	TTL  int      `json:"ttl,omitempty"`
+	Hops []string `json:"hops,omitempty"`
+	// base64 Ed25519 signature of the message without this field
+	Signature string `json:"signature,omitempty"`
 }
 
 type MessageBody struct {
@@ -67,15 +101,36 @@ type MessageBody struct {
 type UpdateFileContent struct {
 	Name    string `json:"name"`
 	Content string `json:"content"`
+	// encoding of Content, see EncodingBase64
+	Encoding string `json:"encoding,omitempty"`
+	// Content is written at Offset instead of replacing the file, or at the end with Append.
+	// Offset can't be past the end of the file
+	Offset *int64 `json:"offset,omitempty"`
+	Append bool   `json:"append,omitempty"`
+	// the write is refused unless the file matches IfMatch and doesn't match IfNoneMatch, see File.ETag
+	IfMatch     string `json:"if_match,omitempty"`
+	IfNoneMatch string `json:"if_none_match,omitempty"`
 }
 
 // used internally
 type CodeInfoContent struct {
 	Code    Code   `json:"code"`
 	Content string `json:"content"`
+	// encoding of the file content in the response of CodeReadFile
+	Encoding string `json:"encoding,omitempty"`
+	// CodeReadFile of Length bytes at Offset(up to the end if Length is 0), a negative Offset counts from the end.
+	// The response is a CodeInfoContent with the range read and the Size of the file
+	Offset int64 `json:"offset,omitempty"`
+	Length int64 `json:"length,omitempty"`
+	Size   int64 `json:"size,omitempty"`
 }
 
-type NetClient func(remoteAddr string, message *Message) (*Message, error)
+// file contents are sent as JSON strings, EncodingBase64 keeps binary contents intact.
+// An empty encoding means the content is sent as it is
+const EncodingBase64 = "base64"
+
+// NetClient sends message to the node at remoteAddr and returns its response, it must give up once ctx is done
+type NetClient func(ctx context.Context, remoteAddr string, message *Message) (*Message, error)
 
 type Code uint32
 
@@ -93,6 +148,24 @@ const (
 	CodeDeleteFile
 	CodeRegister
 	CodeDrop
+	CodeElection
+	CodeCoordinator
+	CodeCreateDir
+	CodeRenameDir
+	CodeDeleteDir
+	CodeReadChunk
+	CodeWriteChunk
+	CodeReplicate
+	CodeTransferFile
+	CodePingReq
+	CodeDigest
+	CodeListVersions
+	CodeReadVersion
+	CodeDiffVersions
+	CodeRestoreVersion
+	CodeUpdateBatch
+	CodeNeighbours
+	CodeTransferVersion
 )
 
 func (c Code) String() string {
@@ -110,6 +183,24 @@ func (c Code) String() string {
 		"CodeDeleteFile",
 		"CodeRegister",
 		"CodeDrop",
+		"CodeElection",
+		"CodeCoordinator",
+		"CodeCreateDir",
+		"CodeRenameDir",
+		"CodeDeleteDir",
+		"CodeReadChunk",
+		"CodeWriteChunk",
+		"CodeReplicate",
+		"CodeTransferFile",
+		"CodePingReq",
+		"CodeDigest",
+		"CodeListVersions",
+		"CodeReadVersion",
+		"CodeDiffVersions",
+		"CodeRestoreVersion",
+		"CodeUpdateBatch",
+		"CodeNeighbours",
+		"CodeTransferVersion",
 	}
 	if int(c) < len(cName) {
 		return cName[c]
@@ -120,23 +211,35 @@ func (c Code) String() string {
 type ResponseStatus string
 
 const (
-	StatusOk            ResponseStatus = "OK"
-	StatusNotOauth      ResponseStatus = "Node Not Authorized"
-	StatusBadFormat     ResponseStatus = "Message Bad Format"
-	StatusInternalError ResponseStatus = "Internal Error"
-	StatusNodeNotOnline ResponseStatus = "Node Not Online"
-	StatusNodeExist     ResponseStatus = "Node Exist"
-	StatusFileExist     ResponseStatus = "File Exist"
-	StatusFileNotFound  ResponseStatus = "File Not Found"
-	StatusFileUpdateOld ResponseStatus = "File Update Old"
+	StatusOk                 ResponseStatus = "OK"
+	StatusNotOauth           ResponseStatus = "Node Not Authorized"
+	StatusBadFormat          ResponseStatus = "Message Bad Format"
+	StatusInternalError      ResponseStatus = "Internal Error"
+	StatusNodeNotOnline      ResponseStatus = "Node Not Online"
+	StatusNodeExist          ResponseStatus = "Node Exist"
+	StatusFileExist          ResponseStatus = "File Exist"
+	StatusFileNotFound       ResponseStatus = "File Not Found"
+	StatusFileUpdateOld      ResponseStatus = "File Update Old"
+	StatusIsDir              ResponseStatus = "Is A Directory"
+	StatusDirNotFound        ResponseStatus = "Directory Not Found"
+	StatusDirNotEmpty        ResponseStatus = "Directory Not Empty"
+	StatusBadFileName        ResponseStatus = "Bad File Name"
+	StatusBadOffset          ResponseStatus = "Bad Offset"
+	StatusNodeDraining       ResponseStatus = "Node Draining"
+	StatusFileConflict       ResponseStatus = "File Conflict"
+	StatusPreconditionFailed ResponseStatus = "Precondition Failed"
+	StatusChecksumMismatch   ResponseStatus = "Checksum Mismatch"
+	StatusNoRoute            ResponseStatus = "No Route"
 )
 
 // const TimeFormat = time.RFC3339Nano
 
 // NodeConfig is internally used by an online node
 type NodeConfig struct {
-	// The local directory for owned files
+	// The local directory for owned files and the state store
 	BaseFilePath string
+	// where owned files are kept, LocalStorage(BaseFilePath) if nil
+	Storage Storage
 	// in-memory copy of record
 	Record Record
 	// Internet address of the node
@@ -145,14 +248,79 @@ type NodeConfig struct {
 	Node Node
 	// Network client
 	NetClient NetClient
+	// deadline of every message sent through NetClient, 10s if 0
+	RequestTimeout time.Duration
+	// how idempotent messages are sent again after a network error
+	Retry RetryPolicy
+	// peers messaged at once by a broadcast, 32 if 0
+	FanOut int
+	// nodes messaged directly, messages for the others are forwarded by them. Every node if 0
+	MaxNeighbours int
+	// updates queued within BatchWindow are sent to a peer in one message, 5ms if 0
+	BatchWindow time.Duration
+	// Network client for chunks of files, optional
+	StreamClient StreamClient
+	// number of other nodes holding a copy of each owned file, replication needs StreamClient
+	ReplicationFactor int
+	// number of past versions kept for each owned file
+	MaxVersions int
+	// signs messages of this node
+	privateKey ed25519.PrivateKey
+	// nonces of recently received messages
+	noncesMx *sync.Mutex
+	nonces   map[string]time.Time
 	// initiator shows that this nodes is mesh initiator
-	initiator     Node
-	updatesChan   chan *UpdateTime
-	stopNode      chan bool
-	initiatorPing *time.Ticker
+	initiator Node
+	stopNode  chan bool
+	// ticks the failure detector
+	probeTicker   *time.Ticker
 	nodesRwMx     *sync.RWMutex
 	dirsRwMx      *sync.RWMutex
 	initiatorRwMx *sync.RWMutex
+	electionMx    *sync.Mutex
+	electing      bool
+	// when the last accepted CodeCoordinator was received
+	coordinatorAt time.Time
+	// write-ahead log of the state store
+	storeMx     *sync.Mutex
+	wal         *os.File
+	walEntries  int
+	compactChan chan bool
+	// owned files waiting to be replicated
+	replicateChan chan string
+	// set while owned files are handed over to other nodes
+	drainMx  *sync.Mutex
+	draining bool
+	// failure detector's view of other nodes and the updates to piggyback
+	membersMx   *sync.Mutex
+	members     map[string]*member
+	incarnation uint64
+	gossip      []*gossipItem
+	// last anti-entropy round with each peer
+	syncs *syncStatuses
+	// files deleted lately, guarded by dirsRwMx
+	tombstones map[string]tombstone
+	// orders changes of files and keeps concurrent ones
+	clock       *hybridClock
+	conflictsMx *sync.Mutex
+	conflicts   map[string]Conflict
+	// held from checking an owned file to publishing its write
+	writeMx *sync.Mutex
+	// held while updates of other nodes are applied, a batch is applied as a whole
+	updateMx *sync.Mutex
+	// chunks of the same upload are written one at a time
+	uploads *uploadLocks
+	// updates waiting for each peer
+	outboxMx *sync.Mutex
+	outboxes map[string]*peerOutbox
+	// append-only log of the outboxes, see loadOutboxes
+	outboxLog     *os.File
+	outboxRecords int
+	outboxSeq     uint64
+	// updates being sent by the outboxes, at most FanOut
+	fanOutSlots chan bool
+	// connection scores, neighbours and the links of the mesh
+	routes *meshRoutes
 }
 
 func (node *NodeConfig) meshInitiator() Node {
@@ -161,10 +329,40 @@ func (node *NodeConfig) meshInitiator() Node {
 	return node.initiator
 }
 
+// SetMeshInitiator records nd as the mesh initiator. An empty address means this node is the initiator
 func (node *NodeConfig) SetMeshInitiator(nd Node) {
 	node.initiatorRwMx.Lock()
-	defer node.initiatorRwMx.Unlock()
 	node.initiator = nd
+	node.initiatorRwMx.Unlock()
+
+	name := nd.Oauth.UserName
+	if nd.Address == "" {
+		name = node.Node.Oauth.UserName
+	}
+	node.nodesRwMx.Lock()
+	defer node.nodesRwMx.Unlock()
+	node.Record.OnlineNodes.Initiator = name
+}
+
+func (node *NodeConfig) isMeshInitiator() bool {
+	return node.meshInitiator().Address == ""
+}
+
+// only one election can run at a time on a node
+func (node *NodeConfig) beginElection() bool {
+	node.electionMx.Lock()
+	defer node.electionMx.Unlock()
+	if node.electing {
+		return false
+	}
+	node.electing = true
+	return true
+}
+
+func (node *NodeConfig) endElection() {
+	node.electionMx.Lock()
+	defer node.electionMx.Unlock()
+	node.electing = false
 }
 
 func (node *NodeConfig) Init() {
@@ -175,12 +373,37 @@ func (node *NodeConfig) Init() {
 		node.Record.Directory.FilesList = map[string]File{}
 	}
 
-	node.updatesChan = make(chan *UpdateTime, 100)
-	node.initiatorPing = time.NewTicker(time.Second)
+	node.probeTicker = time.NewTicker(time.Second)
 	node.stopNode = make(chan bool)
 	node.nodesRwMx = &sync.RWMutex{}
 	node.dirsRwMx = &sync.RWMutex{}
 	node.initiatorRwMx = &sync.RWMutex{}
+	node.electionMx = &sync.Mutex{}
+	node.storeMx = &sync.Mutex{}
+	node.compactChan = make(chan bool, 1)
+	node.replicateChan = make(chan string, 100)
+	node.drainMx = &sync.Mutex{}
+	node.membersMx = &sync.Mutex{}
+	node.members = map[string]*member{}
+	// a restarted node must override what the mesh remembers about it
+	node.incarnation = uint64(time.Now().UnixNano())
+	node.syncs = &syncStatuses{peers: map[string]SyncStatus{}}
+	node.tombstones = map[string]tombstone{}
+	node.clock = &hybridClock{}
+	node.conflictsMx = &sync.Mutex{}
+	node.conflicts = map[string]Conflict{}
+	node.writeMx = &sync.Mutex{}
+	node.noncesMx = &sync.Mutex{}
+	node.nonces = map[string]time.Time{}
+	node.updateMx = &sync.Mutex{}
+	node.uploads = &uploadLocks{locks: map[string]*uploadLock{}}
+	node.outboxMx = &sync.Mutex{}
+	node.outboxes = map[string]*peerOutbox{}
+	// above every seq of a previous run
+	node.outboxSeq = uint64(time.Now().UnixNano())
+	node.setRequestDefaults()
+	node.fanOutSlots = make(chan bool, node.FanOut)
+	node.routes = newMeshRoutes()
 }
 
 // The following avoid reads and writes to be synced
@@ -211,6 +434,8 @@ func (node *NodeConfig) setOnlineNodes(nodes OnlineNodes) {
 	node.nodesRwMx.Lock()
 	defer node.nodesRwMx.Unlock()
 	node.Record.OnlineNodes = nodes
+	content, _ := json.Marshal(&nodes)
+	node.journal(updateTimeNow(CodeNodes, nodes.RecentUpdate.By, string(content)))
 }
 
 func (node *NodeConfig) getNode(nodeName string) (Node, bool) {
@@ -220,11 +445,33 @@ func (node *NodeConfig) getNode(nodeName string) (Node, bool) {
 	return cl, ok
 }
 
+// onlineCount returns the number of online nodes, this one included
+func (node *NodeConfig) onlineCount() int {
+	node.nodesRwMx.RLock()
+	defer node.nodesRwMx.RUnlock()
+	return len(node.Record.OnlineNodes.NodesList)
+}
+
+// NodeByAddress finds an online node by its address
+func (node *NodeConfig) NodeByAddress(address string) (Node, bool) {
+	node.nodesRwMx.RLock()
+	defer node.nodesRwMx.RUnlock()
+	for _, n := range node.Record.OnlineNodes.NodesList {
+		if n.Address == address {
+			return n, true
+		}
+	}
+	return Node{}, false
+}
+
 func (node *NodeConfig) createNode(cl Node, updateTime UpdateTime) {
 	node.nodesRwMx.Lock()
-	defer node.nodesRwMx.Unlock()
 	node.Record.OnlineNodes.NodesList[cl.Oauth.UserName] = cl
 	node.Record.OnlineNodes.RecentUpdate = updateTime
+	content, _ := json.Marshal(&cl)
+	node.journal(UpdateTime{At: updateTime.At, By: updateTime.By, Code: CodeRegister, Content: string(content)})
+	node.nodesRwMx.Unlock()
+	node.memberJoined(cl.Oauth.UserName)
 }
 
 func (node *NodeConfig) deleteNode(nodeName string, updateTime UpdateTime) {
@@ -232,6 +479,8 @@ func (node *NodeConfig) deleteNode(nodeName string, updateTime UpdateTime) {
 	defer node.nodesRwMx.Unlock()
 	delete(node.Record.OnlineNodes.NodesList, nodeName)
 	node.Record.OnlineNodes.RecentUpdate = updateTime
+	content, _ := json.Marshal(&Node{Oauth: Oauth{UserName: nodeName}})
+	node.journal(UpdateTime{At: updateTime.At, By: updateTime.By, Code: CodeDrop, Content: string(content)})
 	log.Printf("Deleted node(%q)\n", nodeName)
 }
 
@@ -245,6 +494,8 @@ func (node *NodeConfig) setDir(dir Directory) {
 	node.dirsRwMx.Lock()
 	defer node.dirsRwMx.Unlock()
 	node.Record.Directory = dir
+	content, _ := json.Marshal(&dir)
+	node.journal(updateTimeNow(CodeDirectory, dir.RecentUpdate.By, string(content)))
 }
 
 func (node *NodeConfig) getFile(fileName string) (File, bool) {
@@ -259,11 +510,49 @@ func (node *NodeConfig) createFile(f File) {
 	defer node.dirsRwMx.Unlock()
 	node.Record.Directory.FilesList[f.Name] = f
 	node.Record.Directory.RecentUpdate = f.RecentUpdate
+	content, _ := json.Marshal(&f)
+	node.journal(UpdateTime{At: f.RecentUpdate.At, By: f.RecentUpdate.By, Code: CodeCreateFile, Content: string(content)})
 }
 
 func (node *NodeConfig) deleteFile(fileName string, updateTime UpdateTime) {
 	node.dirsRwMx.Lock()
 	defer node.dirsRwMx.Unlock()
+	// the log keeps the tombstone of the file
+	buried := File{Name: fileName}
+	if f, ok := node.Record.Directory.FilesList[fileName]; ok {
+		buried = node.bury(f)
+	}
 	delete(node.Record.Directory.FilesList, fileName)
 	node.Record.Directory.RecentUpdate = updateTime
+	content, _ := json.Marshal(&buried)
+	node.journal(UpdateTime{At: updateTime.At, By: updateTime.By, Code: CodeDeleteFile, Content: string(content)})
+}
+
+// renameDir moves dirName and all entries under it to newName, the version of every moved entry is bumped for the
+// node that renamed it so all nodes end with the same vectors
+func (node *NodeConfig) renameDir(dirName, newName string, updateTime UpdateTime) {
+	node.dirsRwMx.Lock()
+	defer node.dirsRwMx.Unlock()
+	moved := []File{}
+	for name, f := range node.Record.Directory.FilesList {
+		if name == dirName || strings.HasPrefix(name, dirName+"/") {
+			moved = append(moved, f)
+		}
+	}
+
+	updateTime.Content = ""
+	for _, f := range moved {
+		buried := node.bury(f)
+		delete(node.Record.Directory.FilesList, f.Name)
+		content, _ := json.Marshal(&buried)
+		node.journal(UpdateTime{At: updateTime.At, By: updateTime.By, Code: CodeDeleteFile, Content: string(content)})
+
+		f.Name = newName + strings.TrimPrefix(f.Name, dirName)
+		f.RecentUpdate = updateTime
+		f.Versions = bumpVersion(f.Versions, updateTime.By)
+		node.Record.Directory.FilesList[f.Name] = f
+		content, _ = json.Marshal(&f)
+		node.journal(UpdateTime{At: updateTime.At, By: updateTime.By, Code: CodeCreateFile, Content: string(content)})
+	}
+	node.Record.Directory.RecentUpdate = updateTime
 }
@@ -0,0 +1,465 @@
+package node
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// UPDATES ARE SENT THROUGH A DURABLE OUTBOX PER PEER
+//
+// Every update(CodeUpdate) is appended to the outbox of each online peer and sent by a goroutine of that peer
+// (at most FanOut of them at once), so a slow or unreachable peer never delays the others or the client.
+// The updates waiting for a peer are sent together, see batch.go.
+// An update stays queued until the peer answers, failed attempts are retried with exponential backoff.
+// A queued update is replaced by a later one about the same node or list of nodes, since updates carry
+// the whole state of what they describe. A file created or written is replaced by a later write of it, never by
+// a deletion or a creation, see replacesUpdate.
+//
+// Queued and acknowledged updates are appended to a log($BaseFilePath/.webdir/outbox.log), replayed on start.
+// The log is truncated once every outbox is empty and rewritten after outboxCompactAfter records.
+// Outboxes are dropped with their peer.
+
+const (
+	outboxLogName = "outbox.log"
+	// records of the log before it is rewritten with the updates still queued only
+	outboxCompactAfter = 10000
+	outboxMinBackoff   = 500 * time.Millisecond
+	outboxMaxBackoff   = time.Minute
+	// failed attempts between two logs
+	outboxLogEvery = 10
+)
+
+// OutboxStatus is the backlog of updates waiting for a peer
+type OutboxStatus struct {
+	Peer    string `json:"peer"`
+	Backlog int    `json:"backlog"`
+	// queued time of the oldest update
+	Oldest    time.Time `json:"oldest"`
+	Attempts  int       `json:"attempts"`
+	NextTry   time.Time `json:"next_try"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+type outboxEntry struct {
+	Seq      uint64     `json:"seq"`
+	Update   UpdateTime `json:"update"`
+	QueuedAt time.Time  `json:"queued_at"`
+}
+
+// outboxRecord is a line of the outbox log, either Entry queued for Peers,
+// or Seq acknowledged by Peer(every update of Peer is dropped if Seq is 0)
+type outboxRecord struct {
+	Entry *outboxEntry `json:"entry,omitempty"`
+	Peers []string     `json:"peers,omitempty"`
+	Peer  string       `json:"peer,omitempty"`
+	Seq   uint64       `json:"seq,omitempty"`
+}
+
+type peerOutbox struct {
+	peer     string
+	entries  []*outboxEntry
+	attempts int
+	nextTry  time.Time
+	lastErr  string
+	// wakes the sender of the peer, never blocks
+	signal chan bool
+}
+
+func outboxLogPath(node *NodeConfig) string {
+	return filepath.Join(stateDir(node), outboxLogName)
+}
+
+// queueUpdate appends updates to the outbox of every online peer, it never blocks on the network
+func (node *NodeConfig) queueUpdate(updates UpdateTime) {
+	log.Printf("Queueing new updates(%s)\n", updates.Code)
+	peers := copyNodesAddress(node)
+	node.outboxMx.Lock()
+	defer node.outboxMx.Unlock()
+	node.outboxSeq++
+	entry := outboxEntry{Seq: node.outboxSeq, Update: updates, QueuedAt: time.Now()}
+	names := []string{}
+	for _, n := range peers {
+		box := node.outboxLocked(n.Oauth.UserName)
+		queued := entry
+		box.entries = coalesceUpdate(box.entries, &queued)
+		wakeOutbox(box)
+		names = append(names, n.Oauth.UserName)
+	}
+	if len(names) > 0 {
+		node.logOutboxLocked(outboxRecord{Entry: &entry, Peers: names})
+	}
+}
+
+// outboxLocked returns the outbox of peer, its sender is started with it
+func (node *NodeConfig) outboxLocked(peer string) *peerOutbox {
+	box, ok := node.outboxes[peer]
+	if !ok {
+		box = &peerOutbox{peer: peer, signal: make(chan bool, 1)}
+		node.outboxes[peer] = box
+		go nodeOutbox(node, box)
+	}
+	return box
+}
+
+func wakeOutbox(box *peerOutbox) {
+	select {
+	case box.signal <- true:
+	default:
+	}
+}
+
+// coalesceKey returns what an update describes, updates with the same key replace each other
+func coalesceKey(updates UpdateTime) string {
+	switch updates.Code {
+	case CodeRegister, CodeDrop:
+		var n Node
+		if json.Unmarshal([]byte(updates.Content), &n) == nil {
+			return "node:" + n.Oauth.UserName
+		}
+	case CodeNodes:
+		return "nodes"
+	case CodeDirectory:
+		return "directory"
+	case CodeNeighbours:
+		return "neighbours:" + updates.By
+	case CodeCreateFile, CodeUpdateFile, CodeDeleteFile, CodeCreateDir, CodeDeleteDir:
+		var f File
+		if json.Unmarshal([]byte(updates.Content), &f) == nil {
+			return "file:" + f.Name
+		}
+	}
+	return ""
+}
+
+// coalesceUpdate appends entry to entries, dropping the queued update it replaces.
+// Renames move many files at once, nothing is coalesced across them
+func coalesceUpdate(entries []*outboxEntry, entry *outboxEntry) []*outboxEntry {
+	key := coalesceKey(entry.Update)
+	for i := len(entries) - 1; i >= 0 && key != ""; i-- {
+		queued := entries[i].Update
+		if queued.Code == CodeRenameDir {
+			break
+		}
+		if coalesceKey(queued) != key {
+			continue
+		}
+		if !replacesUpdate(queued.Code, entry.Update.Code) {
+			break
+		}
+		// a peer that never got the creation can't apply a write
+		if (queued.Code == CodeCreateFile || queued.Code == CodeCreateDir) && entry.Update.Code == CodeUpdateFile {
+			entry.Update.Code = queued.Code
+		}
+		entry.QueuedAt = entries[i].QueuedAt
+		entries = append(entries[:i], entries[i+1:]...)
+		break
+	}
+	return append(entries, entry)
+}
+
+// replacesUpdate reports whether an update(code) makes a queued update about the same key useless.
+// A file is only replaced by a write of itself: a peer must get a deletion before a new file of the same name,
+// the version vector of the new file is behind the one of the deleted file
+func replacesUpdate(queued, code Code) bool {
+	switch code {
+	case CodeUpdateFile:
+		return queued == CodeCreateFile || queued == CodeUpdateFile
+	case CodeCreateFile, CodeDeleteFile, CodeCreateDir, CodeDeleteDir:
+		return false
+	}
+	return true
+}
+
+// ackOutbox removes the update seq from entries
+func ackOutbox(entries []*outboxEntry, seq uint64) []*outboxEntry {
+	for i, entry := range entries {
+		if entry.Seq == seq {
+			return append(entries[:i], entries[i+1:]...)
+		}
+	}
+	return entries
+}
+
+// logOutboxLocked appends rec to the outbox log, nothing is written before loadOutboxes opened it
+func (node *NodeConfig) logOutboxLocked(rec outboxRecord) {
+	if node.outboxLog == nil {
+		return
+	}
+	raw, _ := json.Marshal(&rec)
+	_, err := node.outboxLog.Write(append(raw, '\n'))
+	if err == nil {
+		// a queued update survives a crash once the client got its answer
+		err = node.outboxLog.Sync()
+	}
+	if err != nil {
+		log.Printf("(logOutbox) error: %q\n", err)
+		return
+	}
+	node.outboxRecords++
+	if node.outboxRecords >= outboxCompactAfter {
+		node.compactOutboxLocked()
+	}
+}
+
+// compactOutboxLocked rewrites the outbox log with the updates still queued, it is (re)opened for appending
+func (node *NodeConfig) compactOutboxLocked() {
+	records := 0
+	var compacted bytes.Buffer
+	for peer, box := range node.outboxes {
+		for _, entry := range box.entries {
+			raw, _ := json.Marshal(outboxRecord{Entry: entry, Peers: []string{peer}})
+			compacted.Write(append(raw, '\n'))
+			records++
+		}
+	}
+	// synced before and after the rename, like the snapshot
+	err := replaceFile(outboxLogPath(node), compacted.Bytes())
+	if err != nil {
+		log.Printf("(compactOutbox) error: %q\n", err)
+		return
+	}
+	if node.outboxLog != nil {
+		node.outboxLog.Close()
+	}
+	node.outboxLog, err = os.OpenFile(outboxLogPath(node), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		log.Printf("(compactOutbox) error: %q\n", err)
+	}
+	node.outboxRecords = records
+}
+
+// truncateOutboxLocked empties the log once nothing is queued
+func (node *NodeConfig) truncateOutboxLocked() {
+	if node.outboxLog == nil || node.outboxRecords == 0 {
+		return
+	}
+	for _, box := range node.outboxes {
+		if len(box.entries) > 0 {
+			return
+		}
+	}
+	err := node.outboxLog.Truncate(0)
+	if err == nil {
+		err = node.outboxLog.Sync()
+	}
+	if err != nil {
+		log.Printf("(truncateOutbox) error: %q\n", err)
+		return
+	}
+	node.outboxRecords = 0
+}
+
+// loadOutboxes replays the outbox log, the updates queued before a restart are sent first
+func loadOutboxes(node *NodeConfig) {
+	loaded := map[string][]*outboxEntry{}
+	file, err := os.Open(outboxLogPath(node))
+	if err == nil {
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(nil, 1<<24)
+		for scanner.Scan() {
+			var rec outboxRecord
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+				// a torn write at the end of the log, everything before it is still good
+				log.Printf("(loadOutboxes) skipping broken record: %q\n", err)
+				break
+			}
+			switch {
+			case rec.Entry != nil:
+				for _, peer := range rec.Peers {
+					queued := *rec.Entry
+					loaded[peer] = coalesceUpdate(loaded[peer], &queued)
+				}
+			case rec.Seq == 0:
+				delete(loaded, rec.Peer)
+			default:
+				loaded[rec.Peer] = ackOutbox(loaded[rec.Peer], rec.Seq)
+			}
+		}
+		file.Close()
+	} else if !os.IsNotExist(err) {
+		log.Printf("(loadOutboxes) error: %q\n", err)
+	}
+
+	node.outboxMx.Lock()
+	defer node.outboxMx.Unlock()
+	for peer, entries := range loaded {
+		if len(entries) == 0 {
+			continue
+		}
+		box := node.outboxLocked(peer)
+		box.entries = append(entries, box.entries...)
+		wakeOutbox(box)
+		log.Printf("(loadOutboxes) %d updates waiting for node(%s)\n", len(entries), peer)
+	}
+	node.compactOutboxLocked()
+}
+
+func closeOutbox(node *NodeConfig) {
+	node.outboxMx.Lock()
+	defer node.outboxMx.Unlock()
+	if node.outboxLog != nil {
+		node.outboxLog.Close()
+		node.outboxLog = nil
+	}
+}
+
+// nodeOutbox sends the updates of box in order until its peer leaves the mesh
+func nodeOutbox(node *NodeConfig, box *peerOutbox) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-box.signal:
+			// let the updates queued right after this one join its batch
+			select {
+			case <-time.After(node.BatchWindow):
+			case <-node.stopNode:
+				return
+			}
+		case <-timer.C:
+		case <-node.stopNode:
+			return
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+
+		wait, done := flushOutbox(node, box)
+		if done {
+			return
+		}
+		if wait > 0 {
+			timer.Reset(wait)
+		}
+	}
+}
+
+// flushOutbox sends the queued updates of box in batches until one fails. It returns how long to wait before the next
+// attempt(0 if nothing is left), done is set once the peer left and its outbox was dropped
+func flushOutbox(node *NodeConfig, box *peerOutbox) (wait time.Duration, done bool) {
+	for {
+		n, online := node.getNode(box.peer)
+		node.outboxMx.Lock()
+		if node.outboxes[box.peer] != box {
+			// dropped
+			node.outboxMx.Unlock()
+			return 0, true
+		}
+		if !online {
+			delete(node.outboxes, box.peer)
+			node.logOutboxLocked(outboxRecord{Peer: box.peer})
+			node.truncateOutboxLocked()
+			node.outboxMx.Unlock()
+			return 0, true
+		}
+		if len(box.entries) == 0 {
+			node.outboxMx.Unlock()
+			return 0, false
+		}
+		if wait := time.Until(box.nextTry); wait > 0 {
+			node.outboxMx.Unlock()
+			return wait, false
+		}
+		size := len(box.entries)
+		if size > maxBatchUpdates {
+			size = maxBatchUpdates
+		}
+		batch := append([]*outboxEntry{}, box.entries[:size]...)
+		node.outboxMx.Unlock()
+
+		updates := make([]UpdateTime, 0, len(batch))
+		for _, entry := range batch {
+			updates = append(updates, entry.Update)
+		}
+		if !node.acquireFanOut() {
+			return 0, true
+		}
+		statuses, err := sendUpdateBatch(node, n, updates)
+		node.releaseFanOut()
+
+		node.outboxMx.Lock()
+		if node.outboxes[box.peer] != box {
+			node.outboxMx.Unlock()
+			return 0, true
+		}
+		if err != nil {
+			box.attempts++
+			box.lastErr = err.Error()
+			box.nextTry = time.Now().Add(outboxBackoff(box.attempts))
+			if box.attempts%outboxLogEvery == 1 {
+				log.Printf("(nodeOutbox) node(%s) unreachable, %d updates waiting: %q\n", box.peer, len(box.entries), err)
+			}
+			node.outboxMx.Unlock()
+			continue
+		}
+		box.attempts, box.lastErr, box.nextTry = 0, "", time.Time{}
+		// entries of the batch may have been replaced by later updates while it was sent
+		for i, entry := range batch {
+			if statuses != nil && statuses[i] == "" {
+				// not applied by the peer, sent again
+				continue
+			}
+			queued := len(box.entries)
+			if queued > 0 && box.entries[0] == entry {
+				box.entries = box.entries[1:]
+			} else {
+				box.entries = ackOutbox(box.entries, entry.Seq)
+			}
+			if len(box.entries) < queued {
+				node.logOutboxLocked(outboxRecord{Peer: box.peer, Seq: entry.Seq})
+			}
+		}
+		if len(box.entries) == 0 {
+			node.truncateOutboxLocked()
+		}
+		node.outboxMx.Unlock()
+	}
+}
+
+func outboxBackoff(attempts int) time.Duration {
+	wait := outboxMinBackoff
+	for i := 1; i < attempts && wait < outboxMaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > outboxMaxBackoff {
+		wait = outboxMaxBackoff
+	}
+	return wait
+}
+
+// dropOutboxes forgets every queued update, a node leaving the mesh has nothing more to tell
+func dropOutboxes(node *NodeConfig) {
+	node.outboxMx.Lock()
+	defer node.outboxMx.Unlock()
+	for peer := range node.outboxes {
+		delete(node.outboxes, peer)
+	}
+	node.compactOutboxLocked()
+}
+
+// ClientOutbox returns the backlog of updates of every peer
+func (node *NodeConfig) ClientOutbox() *MessageBody {
+	node.outboxMx.Lock()
+	statuses := []OutboxStatus{}
+	for _, box := range node.outboxes {
+		status := OutboxStatus{Peer: box.peer, Backlog: len(box.entries), Attempts: box.attempts, LastError: box.lastErr}
+		if len(box.entries) > 0 {
+			status.Oldest = box.entries[0].QueuedAt
+			status.NextTry = box.nextTry
+		}
+		statuses = append(statuses, status)
+	}
+	node.outboxMx.Unlock()
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Peer < statuses[j].Peer })
+	resBody, _ := json.Marshal(statuses)
+	return messageBodyFormat(CodeNone, StatusOk, string(resBody))
+}
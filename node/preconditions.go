@@ -0,0 +1,55 @@
+package node
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CONDITIONAL WRITES
+//
+// The ETag of a file is its creation time and revision, it changes with every write and when the name is created again.
+// Writes and deletes may carry the ETag the client expects(IfMatch) or the ones it doesn't want to overwrite(IfNoneMatch).
+// The owner checks them while holding writeMx, so two clients can't both write over the same version.
+
+// ETag is the quoted entity tag of the current content of f
+func (f File) ETag() string {
+	return fmt.Sprintf(`"%d-%d"`, f.CreatedAt.UnixNano(), f.Revision)
+}
+
+// FileETag returns the ETag of fileName as known by this node, or an empty string if the file doesn't exist.
+// Taken before a read, it is never newer than the content read from the owner
+func (node *NodeConfig) FileETag(fileName string) string {
+	name, err := ParseFileName(fileName)
+	if err != nil {
+		return ""
+	}
+	f, ok := node.getFile(string(name))
+	if !ok || f.IsDir {
+		return ""
+	}
+	return f.ETag()
+}
+
+// checkPreconditions returns StatusPreconditionFailed if f doesn't satisfy the conditions of content
+func checkPreconditions(content UpdateFileContent, f File) ResponseStatus {
+	etag := f.ETag()
+	if content.IfMatch != "" && !MatchETag(content.IfMatch, etag) {
+		return StatusPreconditionFailed
+	}
+	if content.IfNoneMatch != "" && MatchETag(content.IfNoneMatch, etag) {
+		return StatusPreconditionFailed
+	}
+	return StatusOk
+}
+
+// MatchETag reports whether etag is in list, a comma-separated list of ETags or "*".
+// Weak tags(W/) are compared as strong ones
+func MatchETag(list, etag string) bool {
+	for _, tag := range strings.Split(list, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,362 @@
+package node
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FILES ARE REPLICATED ON ReplicationFactor OTHER NODES
+//
+// The owner pushes the content of a file with CodeReplicate(through StreamClient) after every write and lists
+// the holders in File.Replicas. When the owner is gone, reads are served by the replica holders.
+// Every replicateInterval the owner checks its files and replaces replicas that dropped off the mesh,
+// holders prune the copies they are no longer listed for.
+
+const (
+	replicasDirName    = "replicas"
+	replicateInterval  = 10 * time.Second
+	replicaPruneMinAge = time.Minute
+)
+
+func (node *NodeConfig) HandleCodeReplicate(mssg *Message, body io.Reader) *Message {
+	var f File
+	if err := json.Unmarshal([]byte(mssg.Body.Content), &f); err != nil {
+		return responseFormat(node, mssg, StatusBadFormat, true, err.Error())
+	}
+	if name, err := ParseFileName(f.Name); err != nil || string(name) != f.Name {
+		return responseFormat(node, mssg, StatusBadFileName, true, f.Name)
+	}
+	// only the owner pushes replicas of its files. A file we don't know yet is pushed before its creation
+	// reaches us, its replica is pruned if it is never listed
+	sender := mssg.Header.Node.Oauth.UserName
+	if f.Owner != sender || f.IsDir {
+		return responseFormat(node, mssg, StatusBadFormat, true, "")
+	}
+	if current, ok := node.fileByKey(fileKey(f)); ok && current.Owner != sender {
+		return responseFormat(node, mssg, StatusNotOauth, true, "")
+	}
+
+	p := replicaPath(node, f)
+	if err := os.MkdirAll(filepath.Dir(p), 0777); err != nil {
+		return responseFormat(node, mssg, StatusInternalError, true, err.Error())
+	}
+	tmp := p + ".tmp"
+	replica, err := os.Create(tmp)
+	if err != nil {
+		log.Printf("(HandleCodeReplicate) error: %q\n", err)
+		return responseFormat(node, mssg, StatusInternalError, true, err.Error())
+	}
+	if body != nil {
+		// an empty file comes without body
+		_, err = io.Copy(replica, body)
+	}
+	if e := replica.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp, p)
+	}
+	if err != nil {
+		log.Printf("(HandleCodeReplicate) writing replica of %q failed: %q\n", f.Name, err)
+		os.Remove(tmp)
+		return responseFormat(node, mssg, StatusInternalError, true, err.Error())
+	}
+	return responseFormat(node, mssg, StatusOk, true, "")
+}
+
+// replicaPath is where this node keeps its copy of f. The path doesn't depend on the name nor on the owner
+// so renaming a directory or transferring the file doesn't move replicas
+func replicaPath(node *NodeConfig, f File) string {
+	return filepath.Join(stateDir(node), replicasDirName, fileKey(f))
+}
+
+// fileKey identifies f whatever its name and owner are: the node that created it and when
+func fileKey(f File) string {
+	sum := sha256.Sum256([]byte(f.Creator + "\x00" + f.CreatedAt.UTC().Format(time.RFC3339Nano)))
+	return hex.EncodeToString(sum[:])
+}
+
+// fileByKey finds the file identified by key in the record, it may have been renamed
+func (node *NodeConfig) fileByKey(key string) (File, bool) {
+	node.dirsRwMx.RLock()
+	defer node.dirsRwMx.RUnlock()
+	for _, f := range node.Record.Directory.FilesList {
+		if !f.IsDir && fileKey(f) == key {
+			return f, true
+		}
+	}
+	return File{}, false
+}
+
+func deleteReplica(node *NodeConfig, f File) {
+	if err := os.Remove(replicaPath(node, f)); err != nil && !os.IsNotExist(err) {
+		log.Printf("(deleteReplica) removing replica of %q failed: %q\n", f.Name, err)
+	}
+}
+
+// storedFile is the content of a file served by this node, from its storage or from a replica
+type storedFile struct {
+	storage Storage
+	name    FileName
+	size    int64
+}
+
+// open reads length bytes at offset, up to the end if length is 0
+func (sf storedFile) open(offset, length int64) (io.ReadCloser, error) {
+	if offset >= sf.size {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+	return sf.storage.Read(sf.name, offset, length)
+}
+
+// openFile finds the content of fileName, in the storage if this node owns it or in its replica
+func (node *NodeConfig) openFile(fileName string) (storedFile, ResponseStatus) {
+	name, err := ParseFileName(fileName)
+	if err != nil {
+		return storedFile{}, StatusBadFileName
+	}
+	f, ok := node.getFile(string(name))
+	if !ok {
+		return storedFile{}, StatusFileNotFound
+	}
+	if f.IsDir {
+		return storedFile{}, StatusIsDir
+	}
+
+	sf := storedFile{storage: node.Storage, name: name}
+	if f.Owner != node.Node.Oauth.UserName {
+		if !isReplica(f, node.Node.Oauth.UserName) {
+			return storedFile{}, StatusFileNotFound
+		}
+		p := replicaPath(node, f)
+		sf = storedFile{storage: &LocalStorage{Root: filepath.Dir(p)}, name: FileName(filepath.Base(p))}
+	}
+
+	info, err := sf.storage.Stat(sf.name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return storedFile{}, StatusFileNotFound
+	}
+	if err != nil {
+		log.Printf("(openFile) error: %q\n", err)
+		return storedFile{}, StatusInternalError
+	}
+	sf.size = info.Size
+	return sf, StatusOk
+}
+
+func isReplica(f File, userName string) bool {
+	return containsName(f.Replicas, userName)
+}
+
+// readTargets returns the online nodes that can serve the content of f, the owner first
+func (node *NodeConfig) readTargets(f File) []Node {
+	targets := []Node{}
+	if n, ok := node.getNode(f.Owner); ok {
+		targets = append(targets, n)
+	}
+	for _, r := range f.Replicas {
+		if n, ok := node.getNode(r); ok {
+			targets = append(targets, n)
+		}
+	}
+	return targets
+}
+
+// queueReplication asks the replication job to push the content of an owned file again
+func (node *NodeConfig) queueReplication(fileName string) {
+	if node.ReplicationFactor <= 0 {
+		return
+	}
+	select {
+	case node.replicateChan <- fileName:
+	default:
+		// the periodic check will catch up
+	}
+}
+
+func nodeReplicate(node *NodeConfig) {
+	ticker := time.NewTicker(replicateInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case fileName := <-node.replicateChan:
+			if f, ok := node.getFile(fileName); ok && f.Owner == node.Node.Oauth.UserName {
+				replicateFile(node, f, true)
+			}
+		case <-ticker.C:
+			if node.ReplicationFactor > 0 {
+				for _, f := range ownedFiles(node) {
+					replicateFile(node, f, false)
+				}
+			}
+			pruneReplicas(node)
+		case <-node.stopNode:
+			return
+		}
+	}
+}
+
+// replicateFile makes sure f has ReplicationFactor online replicas. If push is false
+// the content is only sent to new holders
+func replicateFile(node *NodeConfig, f File, push bool) {
+	if f.IsDir {
+		return
+	}
+	holders := []string{}
+	for _, r := range f.Replicas {
+		if _, ok := node.getNode(r); ok && r != node.Node.Oauth.UserName {
+			holders = append(holders, r)
+		}
+	}
+	if !push && len(holders) >= node.ReplicationFactor && len(holders) == len(f.Replicas) {
+		return
+	}
+
+	kept := []string{}
+	for _, r := range holders {
+		if len(kept) == node.ReplicationFactor {
+			break
+		}
+		if !push || pushReplica(node, f, r) {
+			kept = append(kept, r)
+		}
+	}
+	for _, candidate := range replicaCandidates(node, f) {
+		if len(kept) == node.ReplicationFactor {
+			break
+		}
+		if !containsName(holders, candidate) && pushReplica(node, f, candidate) {
+			kept = append(kept, candidate)
+		}
+	}
+
+	if equalNames(kept, f.Replicas) {
+		return
+	}
+	// a write while pushing queues a new replication, don't publish an outdated file
+	current, ok := node.getFile(f.Name)
+	if !ok || current.RecentUpdate.Clock != f.RecentUpdate.Clock {
+		return
+	}
+	log.Printf("File %q replicated on %v\n", f.Name, kept)
+	current.Replicas = kept
+	node.createFile(clientMakeCUD(node, current, current.RecentUpdate))
+}
+
+func pushReplica(node *NodeConfig, f File, holder string) bool {
+	n, ok := node.getNode(holder)
+	if !ok {
+		return false
+	}
+	sf, status := node.openFile(f.Name)
+	if status != StatusOk {
+		return false
+	}
+	file, err := sf.open(0, 0)
+	if err != nil {
+		log.Printf("(pushReplica) reading %q failed: %q\n", f.Name, err)
+		return false
+	}
+	defer file.Close()
+
+	f.Replicas = nil
+	fileRaw, _ := json.Marshal(&f)
+	mssg := Message{
+		Header: MessageHeader{
+			Node:        node.Node,
+			Destination: holder,
+		},
+		Body: *messageBodyFormat(CodeReplicate, "", string(fileRaw)),
+	}
+	resMssg, resBody, err := node.sendStream(context.Background(), n.Address, &mssg, file)
+	if resBody != nil {
+		resBody.Close()
+	}
+	if err != nil {
+		log.Printf("(pushReplica) dialing node(%s) error: %q\n", holder, err)
+		return false
+	}
+	if resMssg.Body.Status != StatusOk {
+		log.Printf("(pushReplica) node(%s) responded with %q\n", holder, resMssg.Body.Status)
+		return false
+	}
+	return true
+}
+
+// replicaCandidates orders the online nodes by a hash of their name and the file name,
+// so replicas of different files are spread over the mesh
+func replicaCandidates(node *NodeConfig, f File) []string {
+	candidates := []string{}
+	for _, n := range copyNodesAddress(node) {
+		if n.Oauth.UserName != f.Owner {
+			candidates = append(candidates, n.Oauth.UserName)
+		}
+	}
+	rank := func(name string) string {
+		sum := sha256.Sum256([]byte(f.Name + "\x00" + name))
+		return string(sum[:])
+	}
+	sort.Slice(candidates, func(i, j int) bool { return rank(candidates[i]) < rank(candidates[j]) })
+	return candidates
+}
+
+// pruneReplicas removes the copies this node is no longer listed for
+func pruneReplicas(node *NodeConfig) {
+	dir := filepath.Join(stateDir(node), replicasDirName)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	wanted := map[string]bool{}
+	node.dirsRwMx.RLock()
+	for _, f := range node.Record.Directory.FilesList {
+		if isReplica(f, node.Node.Oauth.UserName) {
+			wanted[filepath.Base(replicaPath(node, f))] = true
+		}
+	}
+	node.dirsRwMx.RUnlock()
+
+	for _, entry := range entries {
+		info, err := entry.Info()
+		// a replica is listed once its owner publishes the file, leave it some time
+		if err != nil || wanted[entry.Name()] || time.Since(info.ModTime()) < replicaPruneMinAge {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+			log.Printf("(pruneReplicas) error: %q\n", err)
+		}
+	}
+}
+
+func equalNames(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func containsName(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,42 @@
+package node
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestReplicateOwner(t *testing.T) {
+	n := newStreamTestNode(t, nil)
+	if m := n.ClientCreateFile("mine.txt"); m.Status != StatusOk {
+		t.Fatal(m.Status)
+	}
+	mine, _ := n.getFile("mine.txt")
+
+	replicate := func(sender string, f File) ResponseStatus {
+		fileRaw, _ := json.Marshal(&f)
+		mssg := &Message{Body: *messageBodyFormat(CodeReplicate, "", string(fileRaw))}
+		mssg.Header.Node.Oauth.UserName = sender
+		return n.HandleCodeReplicate(mssg, strings.NewReader(sender)).Body.Status
+	}
+
+	// a copy of the identity of a file owned by another node
+	forged := mine
+	forged.Name, forged.Owner = "forged.txt", "peer"
+	if status := replicate("peer", forged); status != StatusNotOauth {
+		t.Fatalf("replica of a file of another owner answered with %q", status)
+	}
+	if _, err := os.Stat(replicaPath(n, mine)); !os.IsNotExist(err) {
+		t.Fatalf("forged replica written: %v", err)
+	}
+
+	// the same creation time on another node is another file
+	other := File{Name: "other.txt", Owner: "peer", Creator: "peer", CreatedAt: mine.CreatedAt}
+	if fileKey(other) == fileKey(mine) {
+		t.Fatal("files of different creators share their key")
+	}
+	if status := replicate("peer", other); status != StatusOk {
+		t.Fatalf("replica of a new file answered with %q", status)
+	}
+}
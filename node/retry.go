@@ -0,0 +1,90 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// DEADLINES AND RETRIES OF MESSAGES
+//
+// Every message sent through NetClient carries a context: it is cancelled with the request of the client that caused it
+// and expires after RequestTimeout, so a hung peer can't stall the node. Messages that don't change anything on the
+// receiver(reads, pings, digests) are sent again after a network error, waiting longer after every attempt.
+// Every attempt is signed again since nonces can't be reused.
+
+const (
+	defaultRequestTimeout = 10 * time.Second
+	defaultBackoff        = 100 * time.Millisecond
+	defaultMaxBackoff     = 2 * time.Second
+)
+
+// RetryPolicy tells how messages of idempotent codes are sent again after a network error
+type RetryPolicy struct {
+	// attempts after the first one, 0 never retries
+	Retries int
+	// wait before the first retry, doubled after every retry up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// idempotent reports whether a message of code can be received twice without changing the result
+func (c Code) idempotent() bool {
+	switch c {
+	case CodeGetInfo, CodePing, CodeNodes, CodeDirectory, CodeReadFile, CodePingReq, CodeDigest,
+		CodeReadChunk, CodeListVersions, CodeReadVersion, CodeDiffVersions:
+		return true
+	}
+	return false
+}
+
+// retryable reports whether err is worth another attempt, ctx is the context of the whole call
+func retryable(ctx context.Context, err error) bool {
+	return ctx.Err() == nil && !errors.Is(err, errBadSignature)
+}
+
+// backoff returns the wait before the retry-th retry, with jitter so peers don't retry together
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	wait := p.Backoff
+	for i := 0; i < retry && wait < p.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > p.MaxBackoff {
+		wait = p.MaxBackoff
+	}
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+// sleepContext waits for d, false if ctx is done first
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (node *NodeConfig) setRequestDefaults() {
+	if node.RequestTimeout <= 0 {
+		node.RequestTimeout = defaultRequestTimeout
+	}
+	if node.Retry.Backoff <= 0 {
+		node.Retry.Backoff = defaultBackoff
+	}
+	if node.Retry.MaxBackoff <= 0 {
+		node.Retry.MaxBackoff = defaultMaxBackoff
+	}
+	if node.Retry.MaxBackoff < node.Retry.Backoff {
+		node.Retry.MaxBackoff = node.Retry.Backoff
+	}
+	if node.FanOut <= 0 {
+		node.FanOut = defaultFanOut
+	}
+	if node.BatchWindow <= 0 {
+		node.BatchWindow = defaultBatchWindow
+	}
+}
@@ -0,0 +1,468 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MESSAGES ARE ROUTED THROUGH A PARTIAL MESH
+//
+// With MaxNeighbours set a node only talks directly to its neighbours: the online nodes with the best connection score,
+// the inverse of the average round trip of the messages sent to them(a failure counts as RequestTimeout).
+// Every neighbourRefresh the neighbours and a few other nodes are pinged and the neighbours are picked again,
+// right away once a message to a neighbour failed: the neighbour is dropped until it is picked again.
+// Each node publishes its neighbours with CodeNeighbours(an update like the others), so every node knows the links
+// of the mesh, used both ways, and sends a message for another node to the first hop of the shortest path to it,
+// always one of its own neighbours.
+// A node receiving a message whose Destination is another node forwards it the same way: TTL is decremented and the
+// node is added to Hops. A message is refused with StatusNoRoute once TTL is 0, if it went through the node already
+// or if the next hop can't be reached, the sender takes it as a network error.
+// TTL and Hops change on the way so they are not signed, Destination is.
+// Without a known route(a node that just joined) a message is sent directly. Without MaxNeighbours every node is a neighbour.
+
+const (
+	defaultMaxHops   = 8
+	neighbourRefresh = 10 * time.Second
+	// nodes that are not neighbours pinged by every refresh, a better one may have come
+	neighbourExplore = 3
+	// refreshes between two publications of unchanged neighbours, for the nodes that joined since
+	neighboursAnnounceEvery = 6
+	// weight of the last round trip in the average
+	linkRTTWeight = 0.3
+)
+
+var errNoRoute = errors.New("no route to the destination node")
+
+// NeighboursContent is the content of CodeNeighbours, published by a node with the neighbours it talks to
+type NeighboursContent struct {
+	Neighbours []string `json:"neighbours"`
+}
+
+// LinkScore is the connection score of the direct link to a node
+type LinkScore struct {
+	Node string `json:"node"`
+	// average round trip, failures count as RequestTimeout
+	RTT time.Duration `json:"rtt"`
+	// failures since the last message that went through
+	Failures int `json:"failures"`
+	// 1/RTT in seconds, the neighbours have the highest
+	Score     float64 `json:"score"`
+	Neighbour bool    `json:"neighbour"`
+}
+
+// MeshRoutes is what a node knows about the links of the mesh
+type MeshRoutes struct {
+	Links []LinkScore `json:"links"`
+	// neighbours published by every node
+	Neighbours map[string][]string `json:"neighbours"`
+}
+
+type meshRoutes struct {
+	mx         sync.RWMutex
+	scores     map[string]*LinkScore
+	neighbours []string
+	// neighbours last published
+	announced []string
+	// neighbours published by other nodes and when
+	links   map[string][]string
+	linksAt map[string]time.Time
+	// links of every node both ways, built again once links or neighbours change
+	graph map[string][]string
+	// wakes nodeNeighbours, never blocks
+	refresh chan bool
+}
+
+func newMeshRoutes() *meshRoutes {
+	return &meshRoutes{
+		scores:  map[string]*LinkScore{},
+		links:   map[string][]string{},
+		linksAt: map[string]time.Time{},
+		refresh: make(chan bool, 1),
+	}
+}
+
+// observeLink adds a round trip to the connection score of the direct link to peer
+func (node *NodeConfig) observeLink(peer string, rtt time.Duration, failed bool) {
+	if peer == "" || peer == node.Node.Oauth.UserName {
+		return
+	}
+	node.routes.mx.Lock()
+	defer node.routes.mx.Unlock()
+	link, ok := node.routes.scores[peer]
+	if !ok {
+		link = &LinkScore{Node: peer, RTT: rtt}
+		node.routes.scores[peer] = link
+	}
+	if failed {
+		rtt = node.RequestTimeout
+		link.Failures++
+		node.dropNeighbourLocked(peer)
+	} else {
+		link.Failures = 0
+	}
+	link.RTT = time.Duration(linkRTTWeight*float64(rtt) + (1-linkRTTWeight)*float64(link.RTT))
+	link.Score = 1 / link.RTT.Seconds()
+}
+
+// isNeighbourLocked reports whether messages for peer are sent directly
+func (node *NodeConfig) isNeighbourLocked(peer string) bool {
+	for _, n := range node.routes.neighbours {
+		if n == peer {
+			return true
+		}
+	}
+	return false
+}
+
+// dropNeighbourLocked stops sending directly to peer and picks the neighbours again
+func (node *NodeConfig) dropNeighbourLocked(peer string) {
+	for i, n := range node.routes.neighbours {
+		if n == peer {
+			node.routes.neighbours = append(append([]string{}, node.routes.neighbours[:i]...), node.routes.neighbours[i+1:]...)
+			node.routes.graph = nil
+			select {
+			case node.routes.refresh <- true:
+			default:
+			}
+			return
+		}
+	}
+}
+
+// graphLocked returns the links of every node, node.routes.mx must be held for writing
+func (node *NodeConfig) graphLocked() map[string][]string {
+	if node.routes.graph != nil {
+		return node.routes.graph
+	}
+	self := node.Node.Oauth.UserName
+	// the first hop is always one of our neighbours, whatever other nodes published
+	graph := map[string][]string{self: node.routes.neighbours}
+	for from, to := range node.routes.links {
+		for _, t := range to {
+			if t != self {
+				graph[from] = append(graph[from], t)
+				graph[t] = append(graph[t], from)
+			}
+		}
+	}
+	node.routes.graph = graph
+	return graph
+}
+
+// nextHop returns the node a message for dest is sent to, the nodes of skip are never used.
+// ok is false if dest is not online
+func (node *NodeConfig) nextHop(dest string, skip []string) (Node, bool) {
+	if node.MaxNeighbours <= 0 {
+		return node.getNode(dest)
+	}
+	self := node.Node.Oauth.UserName
+	node.routes.mx.Lock()
+	defer node.routes.mx.Unlock()
+	node.nodesRwMx.RLock()
+	defer node.nodesRwMx.RUnlock()
+	online := node.Record.OnlineNodes.NodesList
+	n, ok := online[dest]
+	if !ok || len(node.routes.neighbours) == 0 || node.isNeighbourLocked(dest) {
+		return n, ok
+	}
+
+	graph := node.graphLocked()
+	first := map[string]string{self: ""}
+	for _, s := range skip {
+		first[s] = ""
+	}
+	queue := []string{self}
+	for len(queue) > 0 {
+		at := queue[0]
+		queue = queue[1:]
+		for _, next := range graph[at] {
+			if _, seen := first[next]; seen {
+				continue
+			}
+			if _, ok := online[next]; !ok {
+				continue
+			}
+			first[next] = first[at]
+			if at == self {
+				first[next] = next
+			}
+			if next == dest {
+				return online[first[next]], true
+			}
+			queue = append(queue, next)
+		}
+	}
+	// no known route, maybe it can be reached directly
+	return n, true
+}
+
+// route returns the address mssg is sent to, mssg carries a TTL if it is forwarded
+func (node *NodeConfig) route(address string, mssg *Message) string {
+	if mssg.Header.Destination == "" {
+		if n, ok := node.NodeByAddress(address); ok {
+			mssg.Header.Destination = n.Oauth.UserName
+		}
+	}
+	dest := mssg.Header.Destination
+	if dest == "" || dest == node.Node.Oauth.UserName {
+		return address
+	}
+	hop, ok := node.nextHop(dest, nil)
+	if !ok || hop.Oauth.UserName == dest {
+		return address
+	}
+	mssg.Header.TTL = defaultMaxHops
+	return hop.Address
+}
+
+// forwardTo checks mssg, whose Destination is another node, and returns the copy sent to the next hop.
+// res is the response if it can't be forwarded
+func (node *NodeConfig) forwardTo(mssg *Message) (fwd Message, hop Node, res *Message) {
+	self := node.Node.Oauth.UserName
+	if mssg.Header.TTL <= 0 {
+		return fwd, hop, responseFormat(node, mssg, StatusNotOauth, false, "")
+	}
+	cl, ok := node.getNode(mssg.Header.Node.Oauth.UserName)
+	if !ok || !node.authorized(cl, mssg) {
+		return fwd, hop, responseFormat(node, mssg, StatusNotOauth, false, "")
+	}
+	for _, h := range mssg.Header.Hops {
+		if h == self {
+			return fwd, hop, responseFormat(node, mssg, StatusNoRoute, true, mssg.Header.Destination)
+		}
+	}
+
+	fwd = *mssg
+	fwd.Header.TTL--
+	fwd.Header.Hops = append(append([]string{}, mssg.Header.Hops...), self)
+	hop, ok = node.nextHop(mssg.Header.Destination, append(fwd.Header.Hops, cl.Oauth.UserName))
+	if !ok || (fwd.Header.TTL == 0 && hop.Oauth.UserName != mssg.Header.Destination) {
+		return fwd, hop, responseFormat(node, mssg, StatusNoRoute, true, mssg.Header.Destination)
+	}
+	return fwd, hop, nil
+}
+
+// forward sends mssg on to its Destination, the response comes back as it is
+func (node *NodeConfig) forward(mssg *Message) *Message {
+	fwd, hop, res := node.forwardTo(mssg)
+	if res != nil {
+		return res
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), node.RequestTimeout)
+	defer cancel()
+	start := time.Now()
+	resMssg, err := node.NetClient(ctx, hop.Address, &fwd)
+	node.observeLink(hop.Oauth.UserName, time.Since(start), err != nil)
+	if err != nil || resMssg == nil {
+		log.Printf("(forward) %s for node(%s) through node(%s) failed: %q\n", mssg.Body.Code, mssg.Header.Destination, hop.Oauth.UserName, err)
+		return responseFormat(node, mssg, StatusNoRoute, true, mssg.Header.Destination)
+	}
+	return resMssg
+}
+
+// forwardStream is forward for StreamClient
+func (node *NodeConfig) forwardStream(ctx context.Context, mssg *Message, body io.Reader) (*Message, io.ReadCloser) {
+	fwd, hop, res := node.forwardTo(mssg)
+	if res != nil {
+		return res, nil
+	}
+	if node.StreamClient == nil {
+		return responseFormat(node, mssg, StatusNoRoute, true, mssg.Header.Destination), nil
+	}
+	ctx, call := newStreamCall(ctx, node.RequestTimeout)
+	if body != nil {
+		body = call.reader(body)
+	}
+	resMssg, resBody, err := node.StreamClient(ctx, hop.Address, &fwd, body)
+	resBody = call.body(resBody)
+	if err != nil || resMssg == nil {
+		log.Printf("(forwardStream) %s for node(%s) through node(%s) failed: %q\n", mssg.Body.Code, mssg.Header.Destination, hop.Oauth.UserName, err)
+		if resBody != nil {
+			resBody.Close()
+		}
+		return responseFormat(node, mssg, StatusNoRoute, true, mssg.Header.Destination), nil
+	}
+	return resMssg, resBody
+}
+
+// PeerOf returns the node mssg was received from: the last hop of a forwarded message, its sender otherwise.
+// ok is false if the last hop is not online
+func (node *NodeConfig) PeerOf(mssg *Message) (Node, bool) {
+	if len(mssg.Header.Hops) == 0 {
+		return mssg.Header.Node, true
+	}
+	return node.getNode(mssg.Header.Hops[len(mssg.Header.Hops)-1])
+}
+
+// nodeNeighbours picks the neighbours again every neighbourRefresh
+func nodeNeighbours(node *NodeConfig) {
+	ticker := time.NewTicker(neighbourRefresh)
+	defer ticker.Stop()
+	refreshNeighbours(node, true)
+	for refreshes := 1; ; refreshes++ {
+		select {
+		case <-ticker.C:
+			refreshNeighbours(node, refreshes%neighboursAnnounceEvery == 0)
+		case <-node.routes.refresh:
+			refreshNeighbours(node, false)
+		case <-node.stopNode:
+			return
+		}
+	}
+}
+
+// refreshNeighbours pings the neighbours and a few other nodes directly and keeps the MaxNeighbours best links.
+// The neighbours are published if they changed or if announce is set
+func refreshNeighbours(node *NodeConfig, announce bool) {
+	peers := copyNodesAddress(node)
+	online := map[string]bool{}
+	for _, n := range peers {
+		online[n.Oauth.UserName] = true
+	}
+
+	node.routes.mx.Lock()
+	for name := range node.routes.scores {
+		if !online[name] {
+			delete(node.routes.scores, name)
+		}
+	}
+	for name := range node.routes.links {
+		if !online[name] {
+			delete(node.routes.links, name)
+			delete(node.routes.linksAt, name)
+			node.routes.graph = nil
+		}
+	}
+	candidates := []Node{}
+	others := []Node{}
+	for _, n := range peers {
+		if node.isNeighbourLocked(n.Oauth.UserName) {
+			candidates = append(candidates, n)
+		} else {
+			others = append(others, n)
+		}
+	}
+	explore := neighbourExplore
+	if missing := node.MaxNeighbours - len(candidates); missing > explore {
+		explore = missing
+	}
+	node.routes.mx.Unlock()
+
+	rand.Shuffle(len(others), func(i, j int) { others[i], others[j] = others[j], others[i] })
+	if len(others) > explore {
+		others = others[:explore]
+	}
+	candidates = append(candidates, others...)
+	wg := sync.WaitGroup{}
+	for _, n := range candidates {
+		wg.Add(1)
+		go func(n Node) {
+			defer wg.Done()
+			pingLink(node, n)
+		}(n)
+	}
+	wg.Wait()
+
+	node.routes.mx.Lock()
+	links := []*LinkScore{}
+	for _, link := range node.routes.scores {
+		if link.Failures == 0 {
+			links = append(links, link)
+		}
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i].Score > links[j].Score })
+	neighbours := []string{}
+	for _, link := range links {
+		if len(neighbours) < node.MaxNeighbours {
+			neighbours = append(neighbours, link.Node)
+		}
+	}
+	sort.Strings(neighbours)
+	if !equalStrings(neighbours, node.routes.neighbours) {
+		node.routes.neighbours = neighbours
+		node.routes.graph = nil
+	}
+	changed := !equalStrings(neighbours, node.routes.announced)
+	if changed || announce {
+		node.routes.announced = neighbours
+	}
+	node.routes.mx.Unlock()
+
+	if changed || announce {
+		if changed {
+			log.Printf("(refreshNeighbours) neighbours: %v\n", neighbours)
+		}
+		content, _ := json.Marshal(NeighboursContent{Neighbours: neighbours})
+		node.queueUpdate(updateTimeNow(CodeNeighbours, node.Node.Oauth.UserName, string(content)))
+	}
+}
+
+// pingLink pings n directly, whatever the routes, its round trip is added to the score of the link
+func pingLink(node *NodeConfig, n Node) {
+	mssg := Message{
+		Header: MessageHeader{
+			Node:        node.Node,
+			Destination: n.Oauth.UserName,
+		},
+		Body: MessageBody{
+			Code: CodePing,
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	// sendOnce observes the link
+	node.sendOnce(ctx, n.Address, mssg)
+}
+
+// setLinks records the neighbours published by a node, older publications are ignored
+func (node *NodeConfig) setLinks(updates UpdateTime, content NeighboursContent) {
+	if updates.By == "" || updates.By == node.Node.Oauth.UserName {
+		return
+	}
+	node.routes.mx.Lock()
+	defer node.routes.mx.Unlock()
+	if at, ok := node.routes.linksAt[updates.By]; ok && at.After(updates.At) {
+		return
+	}
+	node.routes.links[updates.By] = content.Neighbours
+	node.routes.linksAt[updates.By] = updates.At
+	node.routes.graph = nil
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// ClientRoutes returns the connection score of every link and the neighbours published by every node
+func (node *NodeConfig) ClientRoutes() *MessageBody {
+	node.routes.mx.RLock()
+	routes := MeshRoutes{Links: []LinkScore{}, Neighbours: map[string][]string{}}
+	for _, link := range node.routes.scores {
+		l := *link
+		l.Neighbour = node.MaxNeighbours <= 0 || node.isNeighbourLocked(l.Node)
+		routes.Links = append(routes.Links, l)
+	}
+	for from, to := range node.routes.links {
+		routes.Neighbours[from] = to
+	}
+	routes.Neighbours[node.Node.Oauth.UserName] = node.routes.neighbours
+	node.routes.mx.RUnlock()
+	sort.Slice(routes.Links, func(i, j int) bool { return routes.Links[i].Score > routes.Links[j].Score })
+	resBody, _ := json.Marshal(routes)
+	return messageBodyFormat(CodeNone, StatusOk, string(resBody))
+}
@@ -0,0 +1,412 @@
+package node
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// STORAGE KEEPS THE CONTENT OF OWNED FILES
+//
+// NodeConfig.Storage is where a node keeps the files and directories it owns, LocalStorage(BaseFilePath) by default.
+// The state store, replicas, uploads and past versions stay under BaseFilePath whatever the storage is.
+// Errors of missing files wrap fs.ErrNotExist.
+
+var errDirNotEmpty = errors.New("directory not empty")
+
+// Storage is the content of the files owned by a node, names are checked by ParseFileName
+type Storage interface {
+	// Create makes an empty file, or a directory if dir is set, and its missing parents. An existing one is kept
+	Create(name FileName, dir bool) error
+	// Read returns length bytes of a file at offset, up to the end if length is 0
+	Read(name FileName, offset, length int64) (io.ReadCloser, error)
+	// Write replaces the content of a file with r
+	Write(name FileName, r io.Reader) error
+	// Delete removes a file or an empty directory
+	Delete(name FileName) error
+	// Rename moves a file or a directory and everything under it, the parent of newName is created if missing
+	Rename(name, newName FileName) error
+	// List returns every file and directory, parents before their children
+	List() ([]StorageInfo, error)
+	Stat(name FileName) (StorageInfo, error)
+}
+
+// StorageWriterAt is implemented by storages that can write a part of a file in place
+type StorageWriterAt interface {
+	// WriteAt writes data at offset, a negative offset appends
+	WriteAt(name FileName, data []byte, offset int64) error
+}
+
+type StorageInfo struct {
+	Name    FileName
+	Size    int64
+	ModTime time.Time
+	IsDir   bool
+}
+
+// writeStorageAt writes data at offset of a file, a negative offset appends
+func writeStorageAt(storage Storage, name FileName, data []byte, offset int64) error {
+	if w, ok := storage.(StorageWriterAt); ok {
+		return w.WriteAt(name, data, offset)
+	}
+	r, err := storage.Read(name, 0, 0)
+	if err != nil {
+		return err
+	}
+	content, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return err
+	}
+	if offset < 0 || offset > int64(len(content)) {
+		offset = int64(len(content))
+	}
+	if end := offset + int64(len(data)); end > int64(len(content)) {
+		content = append(content, make([]byte, end-int64(len(content)))...)
+	}
+	copy(content[offset:], data)
+	return storage.Write(name, bytes.NewReader(content))
+}
+
+// LocalStorage keeps files under Root, the state store(Root/.webdir) is not part of it
+type LocalStorage struct {
+	Root string
+}
+
+// path returns the path of name under Root. Symbolic links are never followed,
+// a name that goes through one is rejected so nothing outside Root can be reached.
+// Components that do not exist yet are fine.
+func (s *LocalStorage) path(name FileName) (string, error) {
+	if name == "" {
+		return s.Root, nil
+	}
+	if _, err := ParseFileName(string(name)); err != nil {
+		return "", err
+	}
+
+	current := s.Root
+	for _, component := range strings.Split(string(name), "/") {
+		current = filepath.Join(current, component)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return "", errSymlink
+		}
+	}
+	return filepath.Join(s.Root, filepath.FromSlash(string(name))), nil
+}
+
+func (s *LocalStorage) Create(name FileName, dir bool) error {
+	p, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	if dir {
+		return os.MkdirAll(p, 0777)
+	}
+	// the parent directory may be owned by another node
+	if err := s.Create(parentDir(name), true); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_RDONLY, 0666)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (s *LocalStorage) Read(name FileName, offset, length int64) (io.ReadCloser, error) {
+	p, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	if offset == 0 && length == 0 {
+		return file, nil
+	}
+	if length == 0 {
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		length = info.Size() - offset
+	}
+	return readCloser{io.NewSectionReader(file, offset, length), file}, nil
+}
+
+// Write replaces the file once r was read, the temporary file is kept in the state store so it is never shared
+func (s *LocalStorage) Write(name FileName, r io.Reader) error {
+	p, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	tmpDir := filepath.Join(s.Root, stateDirName, uploadsDirName)
+	if err := os.MkdirAll(tmpDir, 0777); err != nil {
+		return err
+	}
+	tmp := filepath.Join(tmpDir, randomText())
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, r)
+	if e := file.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp, p)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+func (s *LocalStorage) WriteAt(name FileName, data []byte, offset int64) error {
+	p, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	flag := os.O_WRONLY
+	if offset < 0 {
+		flag |= os.O_APPEND
+	}
+	f, err := os.OpenFile(p, flag, 0666)
+	if err != nil {
+		return err
+	}
+	if offset < 0 {
+		_, err = f.Write(data)
+	} else {
+		_, err = f.WriteAt(data, offset)
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+func (s *LocalStorage) Delete(name FileName) error {
+	p, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(p)
+}
+
+func (s *LocalStorage) Rename(name, newName FileName) error {
+	oldPath, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	if err := s.Create(parentDir(newName), true); err != nil {
+		return err
+	}
+	newPath, err := s.path(newName)
+	if err != nil {
+		return err
+	}
+	return os.Rename(oldPath, newPath)
+}
+
+// List skips symbolic links and the state store
+func (s *LocalStorage) List() ([]StorageInfo, error) {
+	infos := []StorageInfo{}
+	err := filepath.WalkDir(s.Root, func(path string, dirEntry os.DirEntry, err error) error {
+		if err != nil || path == s.Root || dirEntry.Type()&os.ModeSymlink != 0 {
+			return nil
+		}
+		rel, err := filepath.Rel(s.Root, path)
+		if err != nil {
+			return nil
+		}
+		name, err := ParseFileName(filepath.ToSlash(rel))
+		if err != nil {
+			return nil
+		}
+		if dirEntry.IsDir() && name == stateDirName {
+			return filepath.SkipDir
+		}
+		info, err := dirEntry.Info()
+		if err != nil || !(info.IsDir() || info.Mode().IsRegular()) {
+			return nil
+		}
+		infos = append(infos, StorageInfo{Name: name, Size: info.Size(), ModTime: info.ModTime(), IsDir: info.IsDir()})
+		return nil
+	})
+	return infos, err
+}
+
+func (s *LocalStorage) Stat(name FileName) (StorageInfo, error) {
+	p, err := s.path(name)
+	if err != nil {
+		return StorageInfo{}, err
+	}
+	info, err := os.Lstat(p)
+	if err != nil {
+		return StorageInfo{}, err
+	}
+	return StorageInfo{Name: name, Size: info.Size(), ModTime: info.ModTime(), IsDir: info.IsDir()}, nil
+}
+
+// MemoryStorage keeps files in memory, they are lost when the node stops
+type MemoryStorage struct {
+	mx      sync.Mutex
+	entries map[FileName]*memoryEntry
+}
+
+type memoryEntry struct {
+	data    []byte
+	modTime time.Time
+	dir     bool
+}
+
+func (s *MemoryStorage) entryLocked(name FileName) (*memoryEntry, error) {
+	if name == "" {
+		return &memoryEntry{dir: true}, nil
+	}
+	if s.entries == nil {
+		s.entries = map[FileName]*memoryEntry{}
+	}
+	e, ok := s.entries[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: string(name), Err: fs.ErrNotExist}
+	}
+	return e, nil
+}
+
+func (s *MemoryStorage) Create(name FileName, dir bool) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	for parent := parentDir(name); parent != ""; parent = parentDir(parent) {
+		if e, err := s.entryLocked(parent); err != nil {
+			s.entries[parent] = &memoryEntry{dir: true, modTime: time.Now()}
+		} else if !e.dir {
+			return &fs.PathError{Op: "mkdir", Path: string(parent), Err: fs.ErrExist}
+		}
+	}
+	if _, err := s.entryLocked(name); err == nil {
+		return nil
+	}
+	s.entries[name] = &memoryEntry{dir: dir, modTime: time.Now()}
+	return nil
+}
+
+func (s *MemoryStorage) Read(name FileName, offset, length int64) (io.ReadCloser, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	e, err := s.entryLocked(name)
+	if err != nil {
+		return nil, err
+	}
+	if e.dir {
+		return nil, &fs.PathError{Op: "read", Path: string(name), Err: errors.New("is a directory")}
+	}
+	size := int64(len(e.data))
+	if offset > size {
+		offset = size
+	}
+	end := size
+	if length > 0 && offset+length < size {
+		end = offset + length
+	}
+	// writes replace data, the slice is never modified
+	return io.NopCloser(bytes.NewReader(e.data[offset:end])), nil
+}
+
+func (s *MemoryStorage) Write(name FileName, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if parent, err := s.entryLocked(parentDir(name)); err != nil || !parent.dir {
+		return &fs.PathError{Op: "write", Path: string(name), Err: fs.ErrNotExist}
+	}
+	if e, err := s.entryLocked(name); err == nil && e.dir {
+		return &fs.PathError{Op: "write", Path: string(name), Err: errors.New("is a directory")}
+	}
+	s.entries[name] = &memoryEntry{data: data, modTime: time.Now()}
+	return nil
+}
+
+func (s *MemoryStorage) Delete(name FileName) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	e, err := s.entryLocked(name)
+	if err != nil {
+		return err
+	}
+	if e.dir {
+		for other := range s.entries {
+			if strings.HasPrefix(string(other), string(name)+"/") {
+				return &fs.PathError{Op: "remove", Path: string(name), Err: errDirNotEmpty}
+			}
+		}
+	}
+	delete(s.entries, name)
+	return nil
+}
+
+func (s *MemoryStorage) Rename(name, newName FileName) error {
+	s.mx.Lock()
+	if _, err := s.entryLocked(name); err != nil {
+		s.mx.Unlock()
+		return err
+	}
+	s.mx.Unlock()
+	if err := s.Create(parentDir(newName), true); err != nil {
+		return err
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	for other, e := range s.entries {
+		if other == name {
+			delete(s.entries, other)
+			s.entries[newName] = e
+		} else if rest, ok := strings.CutPrefix(string(other), string(name)+"/"); ok {
+			delete(s.entries, other)
+			s.entries[FileName(string(newName)+"/"+rest)] = e
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStorage) List() ([]StorageInfo, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	infos := make([]StorageInfo, 0, len(s.entries))
+	for name, e := range s.entries {
+		infos = append(infos, StorageInfo{Name: name, Size: int64(len(e.data)), ModTime: e.modTime, IsDir: e.dir})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
+
+func (s *MemoryStorage) Stat(name FileName) (StorageInfo, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	e, err := s.entryLocked(name)
+	if err != nil {
+		return StorageInfo{}, err
+	}
+	return StorageInfo{Name: name, Size: int64(len(e.data)), ModTime: e.modTime, IsDir: e.dir}, nil
+}
@@ -0,0 +1,535 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3 COMPATIBLE STORAGE
+//
+// Files are objects of Bucket named Prefix + file name, a directory is an empty object whose name ends with "/"
+// or the common prefix of other objects. Requests use path-style URLs and are signed with AWS Signature Version 4,
+// so any S3 compatible server(MinIO, Ceph, a local stand-in...) can be used through Endpoint.
+// Objects larger than a part are written with a multipart upload, so only one part of a file is ever in memory.
+
+// default size of the parts of a multipart upload, S3 refuses parts smaller than 5MiB but the last
+const s3DefaultPartSize = 8 << 20
+
+// S3Storage keeps files in an S3 bucket
+type S3Storage struct {
+	// scheme and host of the server, https://s3.<Region>.amazonaws.com if empty
+	Endpoint string
+	Bucket   string
+	Region   string
+	// prepended to the name of every object
+	Prefix string
+	// requests are not signed if AccessKey is empty
+	AccessKey, SecretKey, SessionToken string
+	// http.DefaultClient if nil
+	Client *http.Client
+	// a request making no progress for Timeout is cancelled, no limit if 0
+	Timeout time.Duration
+	// size of the parts of a multipart upload, s3DefaultPartSize if 0
+	PartSize int64
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (s *S3Storage) key(name FileName) string {
+	prefix := strings.Trim(s.Prefix, "/")
+	if prefix == "" {
+		return string(name)
+	}
+	return prefix + "/" + string(name)
+}
+
+func (s *S3Storage) endpoint() string {
+	if s.Endpoint == "" {
+		return "https://s3." + s.Region + ".amazonaws.com"
+	}
+	return strings.TrimRight(s.Endpoint, "/")
+}
+
+// do sends a request for the object key, a 404 response is returned as fs.ErrNotExist.
+// The request is cancelled once it made no progress for Timeout, reading the response body included
+func (s *S3Storage) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	ctx := context.Background()
+	var call *streamCall
+	if s.Timeout > 0 {
+		ctx, call = newStreamCall(ctx, s.Timeout)
+	}
+	rawPath := "/" + s3Escape(s.Bucket, true) + "/" + s3Escape(key, false)
+	req, err := http.NewRequestWithContext(ctx, method, s.endpoint()+rawPath, bytes.NewReader(body))
+	if err != nil {
+		if call != nil {
+			call.stop()
+		}
+		return nil, err
+	}
+	req.URL.RawQuery = s3Query(query)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.ContentLength = int64(len(body))
+	if len(body) == 0 {
+		// no Transfer-Encoding on empty bodies
+		req.Body = http.NoBody
+	} else if call != nil {
+		req.Body = io.NopCloser(call.reader(bytes.NewReader(body)))
+	}
+	sum := sha256.Sum256(body)
+	s.sign(req, hex.EncodeToString(sum[:]), time.Now())
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		if call != nil {
+			call.stop()
+		}
+		return nil, err
+	}
+	if call != nil {
+		resp.Body = call.body(resp.Body)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, &fs.PathError{Op: strings.ToLower(method), Path: key, Err: fs.ErrNotExist}
+	}
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		mssg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("(S3Storage) %s %s: %s %s", method, key, resp.Status, bytes.TrimSpace(mssg))
+	}
+	return resp, nil
+}
+
+// doClose sends a request and discards the response
+func (s *S3Storage) doClose(method, key string, query url.Values, header http.Header, body []byte) error {
+	resp, err := s.do(method, key, query, header, body)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	return resp.Body.Close()
+}
+
+// sign adds the AWS Signature Version 4 of req to its headers, the signed payload hash is payloadHash
+func (s *S3Storage) sign(req *http.Request, payloadHash string, now time.Time) {
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.AccessKey == "" {
+		return
+	}
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if s.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		k = strings.ToLower(k)
+		if k == "range" || strings.HasPrefix(k, "x-amz-") {
+			headers[k] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	canonicalHeaders := ""
+	for _, k := range names {
+		canonicalHeaders += k + ":" + headers[k] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3Escape(req.URL.Path, false),
+		s3Query(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := []byte("AWS4" + s.SecretKey)
+	for _, part := range []string{date, s.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes everything but unreserved characters, and "/" unless all is set
+func s3Escape(s string, all bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !all) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3Query is the canonical form of query, parameters are sorted by name
+func s3Query(query url.Values) string {
+	params := []string{}
+	for k, values := range query {
+		for _, v := range values {
+			params = append(params, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+func (s *S3Storage) exists(key string) (bool, error) {
+	err := s.doClose(http.MethodHead, key, nil, nil, nil)
+	if err == nil {
+		return true, nil
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return false, err
+}
+
+// list returns the objects under prefix, at most maxKeys if it is not 0
+func (s *S3Storage) list(prefix string, maxKeys int) (*s3ListResult, error) {
+	all := &s3ListResult{}
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	if maxKeys > 0 {
+		query.Set("max-keys", strconv.Itoa(maxKeys))
+	}
+	for {
+		resp, err := s.do(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		page := s3ListResult{}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		all.Contents = append(all.Contents, page.Contents...)
+		if !page.IsTruncated || page.NextContinuationToken == "" || maxKeys > 0 {
+			return all, nil
+		}
+		query.Set("continuation-token", page.NextContinuationToken)
+	}
+}
+
+func (s *S3Storage) Create(name FileName, dir bool) error {
+	if name == "" {
+		return nil
+	}
+	if _, err := ParseFileName(string(name)); err != nil {
+		return err
+	}
+	// parents are kept when their last child is deleted, like directories on disk
+	for parent := parentDir(name); parent != ""; parent = parentDir(parent) {
+		if err := s.doClose(http.MethodPut, s.key(parent)+"/", nil, nil, nil); err != nil {
+			return err
+		}
+	}
+	if dir {
+		return s.doClose(http.MethodPut, s.key(name)+"/", nil, nil, nil)
+	}
+	if ok, err := s.exists(s.key(name)); ok || err != nil {
+		return err
+	}
+	return s.doClose(http.MethodPut, s.key(name), nil, nil, nil)
+}
+
+func (s *S3Storage) Read(name FileName, offset, length int64) (io.ReadCloser, error) {
+	if _, err := ParseFileName(string(name)); err != nil {
+		return nil, err
+	}
+	header := http.Header{}
+	if length > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	} else if offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := s.do(http.MethodGet, s.key(name), nil, header, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		// offset is at or past the end
+		resp.Body.Close()
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+	return resp.Body, nil
+}
+
+// Write reads r a part at a time, an object that fits in one part is written by a single request
+func (s *S3Storage) Write(name FileName, r io.Reader) error {
+	if _, err := ParseFileName(string(name)); err != nil {
+		return err
+	}
+	part, err := s.readPart(r)
+	if err != nil {
+		return err
+	}
+	if int64(len(part)) < s.partSize() {
+		return s.doClose(http.MethodPut, s.key(name), nil, nil, part)
+	}
+	return s.writeMultipart(s.key(name), part, r)
+}
+
+func (s *S3Storage) partSize() int64 {
+	if s.PartSize <= 0 {
+		return s3DefaultPartSize
+	}
+	return s.PartSize
+}
+
+// readPart reads the next part of r, it is shorter than partSize only at the end of r
+func (s *S3Storage) readPart(r io.Reader) ([]byte, error) {
+	part := make([]byte, s.partSize())
+	n := 0
+	// not io.ReadFull, it can't tell the end of r from r failing with io.ErrUnexpectedEOF
+	for n < len(part) {
+		read, err := r.Read(part[n:])
+		n += read
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return part[:n], nil
+}
+
+type s3CompletedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+// writeMultipart uploads first and the rest of r as the parts of key, the upload is aborted on failure so the
+// object is left as it was
+func (s *S3Storage) writeMultipart(key string, first []byte, r io.Reader) (err error) {
+	resp, err := s.do(http.MethodPost, key, url.Values{"uploads": {""}}, nil, nil)
+	if err != nil {
+		return err
+	}
+	initiated := struct{ UploadId string }{}
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		if abortErr := s.doClose(http.MethodDelete, key, url.Values{"uploadId": {initiated.UploadId}}, nil, nil); abortErr != nil {
+			log.Printf("(S3Storage) aborting upload of %q failed: %q\n", key, abortErr)
+		}
+	}()
+
+	completed := struct {
+		XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+		Parts   []s3CompletedPart `xml:"Part"`
+	}{}
+	for part := first; len(part) > 0 || len(completed.Parts) == 0; {
+		query := url.Values{"partNumber": {strconv.Itoa(len(completed.Parts) + 1)}, "uploadId": {initiated.UploadId}}
+		resp, err := s.do(http.MethodPut, key, query, nil, part)
+		if err != nil {
+			return err
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		completed.Parts = append(completed.Parts, s3CompletedPart{len(completed.Parts) + 1, resp.Header.Get("ETag")})
+		if int64(len(part)) < s.partSize() {
+			break
+		}
+		if part, err = s.readPart(r); err != nil {
+			return err
+		}
+	}
+
+	body, _ := xml.Marshal(&completed)
+	resp, err = s.do(http.MethodPost, key, url.Values{"uploadId": {initiated.UploadId}}, nil, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// a failed completion can still answer 200, with an error in the body
+	result := struct {
+		XMLName xml.Name
+		Code    string
+		Message string
+	}{}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil && err != io.EOF {
+		return err
+	}
+	if result.XMLName.Local == "Error" {
+		return fmt.Errorf("(S3Storage) completing upload of %s: %s %s", key, result.Code, result.Message)
+	}
+	return nil
+}
+
+func (s *S3Storage) Delete(name FileName) error {
+	info, err := s.Stat(name)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir {
+		return s.doClose(http.MethodDelete, s.key(name), nil, nil, nil)
+	}
+	marker := s.key(name) + "/"
+	children, err := s.list(marker, 2)
+	if err != nil {
+		return err
+	}
+	for _, object := range children.Contents {
+		if object.Key != marker {
+			return &fs.PathError{Op: "remove", Path: string(name), Err: errDirNotEmpty}
+		}
+	}
+	return s.doClose(http.MethodDelete, marker, nil, nil, nil)
+}
+
+// Rename copies every object on the server then deletes the old ones
+func (s *S3Storage) Rename(name, newName FileName) error {
+	if _, err := ParseFileName(string(newName)); err != nil {
+		return err
+	}
+	info, err := s.Stat(name)
+	if err != nil {
+		return err
+	}
+	if err := s.Create(parentDir(newName), true); err != nil {
+		return err
+	}
+	keys := map[string]string{s.key(name): s.key(newName)}
+	if info.IsDir {
+		keys = map[string]string{}
+		objects, err := s.list(s.key(name)+"/", 0)
+		if err != nil {
+			return err
+		}
+		for _, object := range objects.Contents {
+			keys[object.Key] = s.key(newName) + strings.TrimPrefix(object.Key, s.key(name))
+		}
+	}
+	for oldKey, newKey := range keys {
+		header := http.Header{"X-Amz-Copy-Source": {"/" + s3Escape(s.Bucket, true) + "/" + s3Escape(oldKey, false)}}
+		if err := s.doClose(http.MethodPut, newKey, nil, header, nil); err != nil {
+			return err
+		}
+	}
+	for oldKey := range keys {
+		if err := s.doClose(http.MethodDelete, oldKey, nil, nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// List infers the directories that only exist as the prefix of other objects
+func (s *S3Storage) List() ([]StorageInfo, error) {
+	prefix := s.key("")
+	objects, err := s.list(prefix, 0)
+	if err != nil {
+		return nil, err
+	}
+	found := map[FileName]StorageInfo{}
+	for _, object := range objects.Contents {
+		rel := strings.TrimPrefix(object.Key, prefix)
+		isDir := strings.HasSuffix(rel, "/")
+		name, err := ParseFileName(strings.TrimSuffix(rel, "/"))
+		if err != nil || name == stateDirName || strings.HasPrefix(string(name), stateDirName+"/") {
+			continue
+		}
+		// HEAD responses only have seconds
+		found[name] = StorageInfo{Name: name, Size: object.Size, ModTime: object.LastModified.Truncate(time.Second), IsDir: isDir}
+		for parent := parentDir(name); parent != ""; parent = parentDir(parent) {
+			if _, ok := found[parent]; !ok {
+				found[parent] = StorageInfo{Name: parent, IsDir: true}
+			}
+		}
+	}
+	infos := make([]StorageInfo, 0, len(found))
+	for _, info := range found {
+		infos = append(infos, info)
+	}
+	// a parent sorts before the names it prefixes
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
+
+func (s *S3Storage) Stat(name FileName) (StorageInfo, error) {
+	if name == "" {
+		return StorageInfo{IsDir: true}, nil
+	}
+	if _, err := ParseFileName(string(name)); err != nil {
+		return StorageInfo{}, err
+	}
+	resp, err := s.do(http.MethodHead, s.key(name), nil, nil, nil)
+	if err == nil {
+		resp.Body.Close()
+		modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+		return StorageInfo{Name: name, Size: resp.ContentLength, ModTime: modTime}, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return StorageInfo{}, err
+	}
+	if ok, err := s.exists(s.key(name) + "/"); ok || err != nil {
+		return StorageInfo{Name: name, IsDir: true}, err
+	}
+	children, err := s.list(s.key(name)+"/", 1)
+	if err != nil {
+		return StorageInfo{}, err
+	}
+	if len(children.Contents) > 0 {
+		return StorageInfo{Name: name, IsDir: true}, nil
+	}
+	return StorageInfo{}, &fs.PathError{Op: "stat", Path: string(name), Err: fs.ErrNotExist}
+}
@@ -0,0 +1,338 @@
+package node
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// THE STATE STORE KEEPS THE RECORD ON DISK SO A RESTARTED NODE REMEMBERS IT
+//
+// Every change made to the in-memory Record is appended to a write-ahead log as an UpdateTime entry, the entry of a
+// deleted file carries its tombstone(see antientropy.go).
+// Once the log grows past walCompactAfter entries, the whole state is written to a snapshot and the log is truncated.
+// On start the snapshot is loaded and the log is replayed on top of it.
+// Log entries are synced to disk before the change is acknowledged, the snapshot is synced before it replaces the
+// previous one.
+//
+// The name and private key of the node are written to their own file as soon as the key is generated, so a node
+// killed before its first snapshot still owns its files when it comes back.
+
+const (
+	// hidden directory under BaseFilePath, it is never shared since ParseFileName refuses names starting with it
+	stateDirName     = ".webdir"
+	snapshotFileName = "record.json"
+	walFileName      = "record.wal"
+	identityFileName = "identity.json"
+	walCompactAfter  = 1000
+)
+
+type stateSnapshot struct {
+	Node Node `json:"node"`
+	// only read from snapshots written before identityFileName
+	PrivateKey ed25519.PrivateKey   `json:"private_key,omitempty"`
+	Record     Record               `json:"record"`
+	Tombstones map[string]tombstone `json:"tombstones,omitempty"`
+}
+
+type nodeIdentity struct {
+	UserName   string             `json:"username"`
+	PrivateKey ed25519.PrivateKey `json:"private_key"`
+}
+
+func stateDir(node *NodeConfig) string {
+	return filepath.Join(node.BaseFilePath, stateDirName)
+}
+
+// loadIdentity reads the name and private key of the node. ok is false if none was saved
+func loadIdentity(node *NodeConfig) (id nodeIdentity, ok bool, err error) {
+	raw, err := os.ReadFile(filepath.Join(stateDir(node), identityFileName))
+	if os.IsNotExist(err) {
+		return id, false, nil
+	}
+	if err != nil {
+		return id, false, err
+	}
+	if err = json.Unmarshal(raw, &id); err != nil {
+		return id, false, err
+	}
+	return id, id.UserName != "" && len(id.PrivateKey) == ed25519.PrivateKeySize, nil
+}
+
+// saveIdentity replaces the saved name and private key of the node, only its owner can read it
+func saveIdentity(node *NodeConfig, id nodeIdentity) error {
+	if err := os.MkdirAll(stateDir(node), 0777); err != nil {
+		return err
+	}
+	raw, err := json.Marshal(&id)
+	if err != nil {
+		return err
+	}
+	return replaceFile(filepath.Join(stateDir(node), identityFileName), raw)
+}
+
+// replaceFile atomically replaces path with raw(0600), both the file and its directory are synced
+func replaceFile(path string, raw []byte) error {
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(raw)
+	if err == nil {
+		err = file.Sync()
+	}
+	if e := file.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir makes the files created, renamed or removed in dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// loadState reads the snapshot and replays the write-ahead log. ok is false if nothing was persisted
+func loadState(node *NodeConfig) (state stateSnapshot, ok bool, err error) {
+	raw, err := os.ReadFile(filepath.Join(stateDir(node), snapshotFileName))
+	if err == nil {
+		if err = json.Unmarshal(raw, &state); err != nil {
+			return state, false, err
+		}
+		ok = true
+	} else if !os.IsNotExist(err) {
+		return state, false, err
+	}
+
+	if state.Record.OnlineNodes.NodesList == nil {
+		state.Record.OnlineNodes.NodesList = map[string]Node{}
+	}
+	if state.Record.Directory.FilesList == nil {
+		state.Record.Directory.FilesList = map[string]File{}
+	}
+	if state.Tombstones == nil {
+		state.Tombstones = map[string]tombstone{}
+	}
+
+	wal, err := os.Open(filepath.Join(stateDir(node), walFileName))
+	if os.IsNotExist(err) {
+		return state, ok, nil
+	}
+	if err != nil {
+		return state, false, err
+	}
+	defer wal.Close()
+
+	scanner := bufio.NewScanner(wal)
+	scanner.Buffer(nil, 1<<24)
+	for scanner.Scan() {
+		var entry UpdateTime
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// a torn write at the end of the log, everything before it is still good
+			log.Printf("(loadState) skipping broken log entry: %q\n", err)
+			break
+		}
+		if err := applyJournal(&state, entry); err != nil {
+			log.Printf("(loadState) applying log entry(%s) failed: %q\n", entry.Code, err)
+			continue
+		}
+		ok = true
+	}
+	return state, ok, scanner.Err()
+}
+
+func applyJournal(state *stateSnapshot, entry UpdateTime) error {
+	record := &state.Record
+	recent := entry
+	recent.Content = ""
+
+	switch entry.Code {
+	case CodeRegister, CodeDrop:
+		var n Node
+		if err := json.Unmarshal([]byte(entry.Content), &n); err != nil {
+			return err
+		}
+		if entry.Code == CodeRegister {
+			record.OnlineNodes.NodesList[n.Oauth.UserName] = n
+		} else {
+			delete(record.OnlineNodes.NodesList, n.Oauth.UserName)
+		}
+		record.OnlineNodes.RecentUpdate = recent
+
+	case CodeNodes:
+		var nodes OnlineNodes
+		if err := json.Unmarshal([]byte(entry.Content), &nodes); err != nil {
+			return err
+		}
+		if nodes.NodesList == nil {
+			nodes.NodesList = map[string]Node{}
+		}
+		record.OnlineNodes = nodes
+
+	case CodeDirectory:
+		var dir Directory
+		if err := json.Unmarshal([]byte(entry.Content), &dir); err != nil {
+			return err
+		}
+		if dir.FilesList == nil {
+			dir.FilesList = map[string]File{}
+		}
+		record.Directory = dir
+
+	case CodeCreateFile, CodeDeleteFile:
+		var f File
+		if err := json.Unmarshal([]byte(entry.Content), &f); err != nil {
+			return err
+		}
+		if entry.Code == CodeCreateFile {
+			record.Directory.FilesList[f.Name] = f
+			record.Directory.RecentUpdate = f.RecentUpdate
+		} else {
+			delete(record.Directory.FilesList, f.Name)
+			record.Directory.RecentUpdate = recent
+			// entries written before tombstones were logged only have the name
+			if f.Owner != "" {
+				state.Tombstones[f.Name] = tombstone{File: f, DeletedAt: entry.At}
+			}
+		}
+
+	default:
+		return errors.New("unknown log entry code")
+	}
+	return nil
+}
+
+func openStore(node *NodeConfig) error {
+	if err := os.MkdirAll(stateDir(node), 0777); err != nil {
+		return err
+	}
+	wal, err := os.OpenFile(filepath.Join(stateDir(node), walFileName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	if err := syncDir(stateDir(node)); err != nil {
+		wal.Close()
+		return err
+	}
+	node.storeMx.Lock()
+	defer node.storeMx.Unlock()
+	node.wal = wal
+	return nil
+}
+
+func closeStore(node *NodeConfig) {
+	if err := compactState(node); err != nil {
+		log.Printf("(closeStore) writing snapshot failed: %q\n", err)
+	}
+	node.storeMx.Lock()
+	defer node.storeMx.Unlock()
+	if node.wal != nil {
+		node.wal.Close()
+		node.wal = nil
+	}
+}
+
+// journal appends entry to the write-ahead log. It is called while holding the lock of the changed part of the record
+func (node *NodeConfig) journal(entry UpdateTime) {
+	node.storeMx.Lock()
+	defer node.storeMx.Unlock()
+	if node.wal == nil {
+		return
+	}
+
+	raw, _ := json.Marshal(&entry)
+	if _, err := node.wal.Write(append(raw, '\n')); err != nil {
+		log.Printf("(journal) writing log entry(%s) failed: %q\n", entry.Code, err)
+		return
+	}
+	if err := node.wal.Sync(); err != nil {
+		log.Printf("(journal) syncing log entry(%s) failed: %q\n", entry.Code, err)
+	}
+	node.walEntries++
+	if node.walEntries >= walCompactAfter {
+		select {
+		case node.compactChan <- true:
+		default:
+		}
+	}
+}
+
+// compactState writes the whole state to the snapshot and truncates the write-ahead log
+func compactState(node *NodeConfig) error {
+	// changes to the record are blocked until the log is truncated
+	node.holdAllRLocks()
+	defer node.releaseAllRLocks()
+	node.storeMx.Lock()
+	defer node.storeMx.Unlock()
+	if node.wal == nil {
+		return nil
+	}
+
+	raw, err := json.Marshal(stateSnapshot{Node: node.Node, Record: node.Record, Tombstones: node.tombstones})
+	if err != nil {
+		return err
+	}
+	// the log is only truncated once the snapshot is on disk
+	if err := replaceFile(filepath.Join(stateDir(node), snapshotFileName), raw); err != nil {
+		return err
+	}
+	if err := node.wal.Truncate(0); err != nil {
+		return err
+	}
+	if err := node.wal.Sync(); err != nil {
+		return err
+	}
+	node.walEntries = 0
+	return nil
+}
+
+func nodePersist(node *NodeConfig) {
+	for {
+		select {
+		case <-node.compactChan:
+			if err := compactState(node); err != nil {
+				log.Printf("(nodePersist) writing snapshot failed: %q\n", err)
+			}
+		case <-node.stopNode:
+			return
+		}
+	}
+}
+
+// reconcileRecord merges the record received from the mesh with the state recovered from disk.
+// The mesh knows better about online nodes and files of other nodes, this node knows better about its own files.
+func reconcileRecord(node *NodeConfig, record Record) {
+	if record.OnlineNodes.NodesList == nil {
+		record.OnlineNodes.NodesList = map[string]Node{}
+	}
+	if record.Directory.FilesList == nil {
+		record.Directory.FilesList = map[string]File{}
+	}
+
+	owned := ownedFiles(node)
+	node.setOnlineNodes(record.OnlineNodes)
+	node.setDir(record.Directory)
+	for _, f := range owned {
+		if remote, ok := node.getFile(f.Name); ok && remote.Owner != node.Node.Oauth.UserName {
+			log.Printf("(reconcileRecord) file %q is now owned by node(%s)\n", f.Name, remote.Owner)
+			continue
+		}
+		node.createFile(f)
+	}
+}
@@ -0,0 +1,522 @@
+package node
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// STREAMING FILE TRANSFER
+//
+// Large files don't fit in the JSON envelope, they are moved in chunks through StreamClient: the message travels
+// as usual and the chunk travels next to it as a raw body.
+//
+// CodeReadChunk reads Length bytes at Offset(up to the end of the file if Length is 0).
+// CodeWriteChunk appends to an upload kept by the owner under the state store, Offset must be the current size of the upload.
+// A chunk without body returns the current size so a broken upload can be resumed, the Final chunk moves
+// the upload in place of the file. Every written chunk carries its SHA-256 in the signed ChunkContent, a chunk that
+// doesn't match is dropped. An upload id only refers to uploads of the same file, uploads idle for uploadTTL are removed.
+// A stream call is canceled once RequestTimeout passed without a chunk read from its body or from the response body.
+
+// StreamClient sends message with body and returns the response with its body, the caller must close it.
+// The call, and reading the response body, must stop when ctx is done
+type StreamClient func(ctx context.Context, remoteAddr string, message *Message, body io.Reader) (*Message, io.ReadCloser, error)
+
+// used internally
+type ChunkContent struct {
+	Name   string `json:"name"`
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+	// size of the whole file, set in responses of CodeReadChunk
+	Size   int64  `json:"size,omitempty"`
+	Upload string `json:"upload,omitempty"`
+	Final  bool   `json:"final,omitempty"`
+	// SHA-256 of the body of CodeWriteChunk, in hex
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+const (
+	uploadsDirName      = "uploads"
+	uploadTTL           = 24 * time.Hour
+	uploadSweepInterval = time.Hour
+)
+
+var (
+	errNoStreamClient = errors.New("node has no stream client")
+	errNoResponse     = errors.New("stream call returned no response")
+)
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// streamCall cancels a stream call that made no progress for timeout
+type streamCall struct {
+	cancel  context.CancelFunc
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func newStreamCall(ctx context.Context, timeout time.Duration) (context.Context, *streamCall) {
+	ctx, cancel := context.WithCancel(ctx)
+	return ctx, &streamCall{cancel: cancel, timer: time.AfterFunc(timeout, cancel), timeout: timeout}
+}
+
+// reader gives the call timeout again after every chunk read from r
+func (call *streamCall) reader(r io.Reader) io.Reader {
+	return readerFunc(func(p []byte) (int, error) {
+		n, err := r.Read(p)
+		call.timer.Reset(call.timeout)
+		return n, err
+	})
+}
+
+// body ends the call when the response body is closed, or now if there is none
+func (call *streamCall) body(body io.ReadCloser) io.ReadCloser {
+	if body == nil {
+		call.stop()
+		return nil
+	}
+	return readCloser{
+		Reader: call.reader(body),
+		Closer: closerFunc(func() error {
+			err := body.Close()
+			call.stop()
+			return err
+		}),
+	}
+}
+
+func (call *streamCall) stop() {
+	call.timer.Stop()
+	call.cancel()
+}
+
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) { return f(p) }
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error { return f() }
+
+func (node *NodeConfig) ClientReadStream(ctx context.Context, fileName string, offset, length int64) (*MessageBody, io.ReadCloser) {
+	name, err := ParseFileName(fileName)
+	if err != nil {
+		return messageBodyFormat(CodeReadChunk, StatusBadFileName, fileName), nil
+	}
+	f, ok := node.getFile(string(name))
+	if !ok {
+		return messageBodyFormat(CodeReadChunk, StatusFileNotFound, fileName), nil
+	}
+	targets := node.readTargets(f)
+	if len(targets) == 0 {
+		return messageBodyFormat(CodeReadChunk, StatusNodeNotOnline, f.Owner), nil
+	}
+
+	chunkRaw, _ := json.Marshal(&ChunkContent{Name: string(name), Offset: offset, Length: length})
+	res := messageBodyFormat(CodeReadChunk, StatusNodeNotOnline, f.Owner)
+	// the owner first, then the replicas
+	for _, target := range targets {
+		reqMssg := Message{
+			Header: MessageHeader{
+				Node:        node.Node,
+				Destination: target.Oauth.UserName,
+			},
+			Body: *messageBodyFormat(CodeReadChunk, "", string(chunkRaw)),
+		}
+
+		if target.Oauth.UserName == node.Node.Oauth.UserName {
+			resMssg, body := node.HandleCodeReadChunk(&reqMssg)
+			if resMssg.Body.Status == StatusOk {
+				return &resMssg.Body, body
+			}
+			res = &resMssg.Body
+			continue
+		}
+
+		resMssg, body, err := node.sendStream(ctx, target.Address, &reqMssg, nil)
+		if err != nil {
+			log.Printf("ClientReadStream network error: %q\n", err)
+			res = messageBodyFormat(CodeReadChunk, StatusInternalError, err.Error())
+			continue
+		}
+		if resMssg.Body.Status == StatusOk {
+			return &resMssg.Body, body
+		}
+		if body != nil {
+			body.Close()
+		}
+		res = &resMssg.Body
+	}
+	return res, nil
+}
+
+// ClientWriteStream writes a chunk of an upload, an empty chunk.Upload starts a new one
+func (node *NodeConfig) ClientWriteStream(ctx context.Context, chunk ChunkContent, body io.Reader) *MessageBody {
+	name, err := ParseFileName(chunk.Name)
+	if err != nil {
+		return messageBodyFormat(CodeWriteChunk, StatusBadFileName, chunk.Name)
+	}
+	chunk.Name = string(name)
+	f, ok := node.getFile(chunk.Name)
+	if !ok {
+		return messageBodyFormat(CodeWriteChunk, StatusFileNotFound, chunk.Name)
+	}
+	remoteNode, ok := node.getNode(f.Owner)
+	if !ok {
+		return messageBodyFormat(CodeWriteChunk, StatusNodeNotOnline, f.Owner)
+	}
+
+	chunkRaw, _ := json.Marshal(&chunk)
+	reqMssg := Message{
+		Header: MessageHeader{
+			Node:        node.Node,
+			Destination: f.Owner,
+		},
+		Body: *messageBodyFormat(CodeWriteChunk, "", string(chunkRaw)),
+	}
+
+	if f.Owner == node.Node.Oauth.UserName {
+		return &node.HandleCodeWriteChunk(&reqMssg, body).Body
+	}
+
+	if body != nil && chunk.SHA256 == "" {
+		// the hash is signed with the message, the chunk is read once to compute it
+		spooled, sum, err := spoolChunk(node, body)
+		if err != nil {
+			log.Printf("(ClientWriteStream) error: %q\n", err)
+			return messageBodyFormat(CodeWriteChunk, StatusInternalError, err.Error())
+		}
+		defer func() {
+			spooled.Close()
+			os.Remove(spooled.Name())
+		}()
+		chunk.SHA256 = sum
+		chunkRaw, _ = json.Marshal(&chunk)
+		reqMssg.Body.Content = string(chunkRaw)
+		body = spooled
+	}
+
+	resMssg, resBody, err := node.sendStream(ctx, remoteNode.Address, &reqMssg, body)
+	if err != nil {
+		log.Printf("ClientWriteStream network error: %q\n", err)
+		return messageBodyFormat(CodeWriteChunk, StatusInternalError, err.Error())
+	}
+	if resBody != nil {
+		resBody.Close()
+	}
+	return &resMssg.Body
+}
+
+// spoolChunk copies body to a temporary file of the state store and returns it from the start with its SHA-256
+func spoolChunk(node *NodeConfig, body io.Reader) (*os.File, string, error) {
+	dir := filepath.Join(stateDir(node), uploadsDirName)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, "", err
+	}
+	spooled, err := os.CreateTemp(dir, "chunk-")
+	if err != nil {
+		return nil, "", err
+	}
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(spooled, hash), body)
+	if err == nil {
+		_, err = spooled.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		spooled.Close()
+		os.Remove(spooled.Name())
+		return nil, "", err
+	}
+	return spooled, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// ClientWebDirStream handles a stream message sent from another node, the returned body must be closed
+func (node *NodeConfig) ClientWebDirStream(ctx context.Context, mssg *Message, body io.Reader) (*Message, io.ReadCloser) {
+	if mssg.Header.Destination != "" && mssg.Header.Destination != node.Node.Oauth.UserName {
+		return node.forwardStream(ctx, mssg, body)
+	}
+	cl, ok := node.getNode(mssg.Header.Node.Oauth.UserName)
+	if !ok || !node.authorized(cl, mssg) {
+		return responseFormat(node, mssg, StatusNotOauth, false, ""), nil
+	}
+	node.receiveGossip(mssg)
+
+	switch mssg.Body.Code {
+	case CodeReadChunk:
+		return node.HandleCodeReadChunk(mssg)
+	case CodeWriteChunk:
+		return node.HandleCodeWriteChunk(mssg, body), nil
+	case CodeReplicate:
+		return node.HandleCodeReplicate(mssg, body), nil
+	case CodeTransferFile:
+		return node.HandleCodeTransferFile(mssg, body), nil
+	case CodeTransferVersion:
+		return node.HandleCodeTransferVersion(mssg, body), nil
+	default:
+		return responseFormat(node, mssg, StatusBadFormat, true, ""), nil
+	}
+}
+
+func (node *NodeConfig) HandleCodeReadChunk(mssg *Message) (*Message, io.ReadCloser) {
+	var chunk ChunkContent
+	if err := json.Unmarshal([]byte(mssg.Body.Content), &chunk); err != nil {
+		return responseFormat(node, mssg, StatusBadFormat, true, err.Error()), nil
+	}
+	sf, status := node.openFile(chunk.Name)
+	if status != StatusOk {
+		return responseFormat(node, mssg, status, true, ""), nil
+	}
+
+	chunk.Size = sf.size
+	if chunk.Offset < 0 || chunk.Offset > chunk.Size || chunk.Length < 0 {
+		resBody, _ := json.Marshal(&chunk)
+		return responseFormat(node, mssg, StatusBadOffset, true, string(resBody)), nil
+	}
+	if chunk.Length == 0 || chunk.Offset+chunk.Length > chunk.Size {
+		chunk.Length = chunk.Size - chunk.Offset
+	}
+	file, err := sf.open(chunk.Offset, chunk.Length)
+	if err != nil {
+		log.Printf("(HandleCodeReadChunk) error: %q\n", err)
+		return responseFormat(node, mssg, StatusInternalError, true, err.Error()), nil
+	}
+
+	resBody, _ := json.Marshal(&chunk)
+	return responseFormat(node, mssg, StatusOk, true, string(resBody)), file
+}
+
+func (node *NodeConfig) HandleCodeWriteChunk(mssg *Message, body io.Reader) *Message {
+	var chunk ChunkContent
+	if err := json.Unmarshal([]byte(mssg.Body.Content), &chunk); err != nil {
+		return responseFormat(node, mssg, StatusBadFormat, true, err.Error())
+	}
+	name, f, status := node.ownedFile(chunk.Name)
+	if status != StatusOk {
+		return responseFormat(node, mssg, status, true, "")
+	}
+	if chunk.Upload == "" {
+		chunk.Upload = randomText()
+	}
+	if !validUploadID(chunk.Upload) {
+		return responseFormat(node, mssg, StatusBadFormat, true, "")
+	}
+	// other nodes always sign the hash of their chunk
+	if body != nil && chunk.SHA256 == "" && mssg.Header.Node.Oauth.UserName != node.Node.Oauth.UserName {
+		return responseFormat(node, mssg, StatusBadFormat, true, "")
+	}
+
+	uploadPath := uploadLocation(node, name, chunk.Upload)
+	// chunks of the same upload are written one at a time
+	defer node.uploads.lock(uploadPath)()
+	if err := os.MkdirAll(filepath.Dir(uploadPath), 0777); err != nil {
+		return responseFormat(node, mssg, StatusInternalError, true, err.Error())
+	}
+	upload, err := os.OpenFile(uploadPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		log.Printf("(HandleCodeWriteChunk) error: %q\n", err)
+		return responseFormat(node, mssg, StatusInternalError, true, err.Error())
+	}
+	defer upload.Close()
+	info, err := upload.Stat()
+	if err != nil {
+		return responseFormat(node, mssg, StatusInternalError, true, err.Error())
+	}
+
+	if body == nil && !chunk.Final {
+		chunk.Offset, chunk.Length = info.Size(), 0
+		resBody, _ := json.Marshal(&chunk)
+		return responseFormat(node, mssg, StatusOk, true, string(resBody))
+	}
+	if chunk.Offset != info.Size() {
+		// the client resumes from the size we have
+		chunk.Offset, chunk.Length = info.Size(), 0
+		resBody, _ := json.Marshal(&chunk)
+		return responseFormat(node, mssg, StatusBadOffset, true, string(resBody))
+	}
+
+	chunk.Length = 0
+	if body != nil {
+		hash := sha256.New()
+		chunk.Length, err = io.Copy(io.MultiWriter(upload, hash), body)
+		status := StatusOk
+		if err != nil {
+			log.Printf("(HandleCodeWriteChunk) writing upload %q failed: %q\n", chunk.Upload, err)
+			status = StatusInternalError
+		} else if chunk.SHA256 != "" && !strings.EqualFold(chunk.SHA256, hex.EncodeToString(hash.Sum(nil))) {
+			status = StatusChecksumMismatch
+		}
+		if status != StatusOk {
+			// nothing unchecked is kept, the client sends the chunk again from the size we have
+			if err := upload.Truncate(info.Size()); err != nil {
+				return responseFormat(node, mssg, StatusInternalError, true, err.Error())
+			}
+			chunk.Offset, chunk.Length = info.Size(), 0
+			resBody, _ := json.Marshal(&chunk)
+			return responseFormat(node, mssg, status, true, string(resBody))
+		}
+	}
+	chunk.Offset = info.Size() + chunk.Length
+
+	if chunk.Final {
+		upload.Close()
+		node.writeMx.Lock()
+		defer node.writeMx.Unlock()
+		// the file may have been written since the upload started
+		if name, f, status = node.ownedFile(chunk.Name); status != StatusOk {
+			return responseFormat(node, mssg, status, true, "")
+		}
+		saveVersion(node, name, f)
+		upload, err := os.Open(uploadPath)
+		if err == nil {
+			err = node.Storage.Write(name, upload)
+			upload.Close()
+		}
+		if err != nil {
+			log.Printf("(HandleCodeWriteChunk) moving upload %q failed: %q\n", chunk.Upload, err)
+			return responseFormat(node, mssg, StatusInternalError, true, err.Error())
+		}
+		os.Remove(uploadPath)
+		node.ownedFileWritten(f, mssg.Header.Node.Oauth.UserName)
+	}
+
+	resBody, _ := json.Marshal(&chunk)
+	return responseFormat(node, mssg, StatusOk, true, string(resBody))
+}
+
+// uploadLocks holds a lock for each upload being written
+type uploadLocks struct {
+	mx    sync.Mutex
+	locks map[string]*uploadLock
+}
+
+type uploadLock struct {
+	mx sync.Mutex
+	// chunks holding or waiting for mx
+	users int
+}
+
+// lock waits for the upload at path and returns its unlock
+func (l *uploadLocks) lock(path string) func() {
+	l.mx.Lock()
+	ul, ok := l.locks[path]
+	if !ok {
+		ul = &uploadLock{}
+		l.locks[path] = ul
+	}
+	ul.users++
+	l.mx.Unlock()
+
+	ul.mx.Lock()
+	return func() {
+		ul.mx.Unlock()
+		l.mx.Lock()
+		if ul.users--; ul.users == 0 {
+			delete(l.locks, path)
+		}
+		l.mx.Unlock()
+	}
+}
+
+// sendStream is send for StreamClient, the response body is nil if err is not
+func (node *NodeConfig) sendStream(ctx context.Context, address string, mssg *Message, body io.Reader) (*Message, io.ReadCloser, error) {
+	if node.StreamClient == nil {
+		return &Message{}, nil, errNoStreamClient
+	}
+	signed := *mssg
+	address = node.route(address, &signed)
+	node.signMessage(&signed)
+
+	ctx, call := newStreamCall(ctx, node.RequestTimeout)
+	if body != nil {
+		body = call.reader(body)
+	}
+	resMssg, resBody, err := node.StreamClient(ctx, address, &signed, body)
+	resBody = call.body(resBody)
+	if err != nil || resMssg == nil {
+		if resBody != nil {
+			resBody.Close()
+		}
+		if err == nil {
+			err = errNoResponse
+		}
+		return &Message{}, nil, err
+	}
+
+	if !node.verifyResponse(address, &signed, resMssg) {
+		if resBody != nil {
+			resBody.Close()
+		}
+		return &Message{}, nil, errBadSignature
+	}
+	if _, ok := node.getNode(resMssg.Header.Node.Oauth.UserName); ok {
+		node.receiveGossip(resMssg)
+	}
+	if signed.Header.TTL > 0 && resMssg.Body.Status == StatusNoRoute {
+		if resBody != nil {
+			resBody.Close()
+		}
+		return resMssg, nil, errNoRoute
+	}
+	return resMssg, resBody, nil
+}
+
+// uploadLocation is where the owner keeps upload id of name, the same id of another file is another upload
+func uploadLocation(node *NodeConfig, name FileName, id string) string {
+	sum := sha256.Sum256([]byte(string(name) + "\x00" + id))
+	return filepath.Join(stateDir(node), uploadsDirName, hex.EncodeToString(sum[:]))
+}
+
+func nodeUploads(node *NodeConfig) {
+	ticker := time.NewTicker(uploadSweepInterval)
+	defer ticker.Stop()
+	for {
+		pruneUploads(node)
+		select {
+		case <-ticker.C:
+		case <-node.stopNode:
+			return
+		}
+	}
+}
+
+// pruneUploads removes the uploads and spooled chunks that were not written for uploadTTL
+func pruneUploads(node *NodeConfig) {
+	dir := filepath.Join(stateDir(node), uploadsDirName)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < uploadTTL {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+			log.Printf("(pruneUploads) error: %q\n", err)
+		}
+	}
+}
+
+func validUploadID(id string) bool {
+	if len(id) == 0 || len(id) > 64 {
+		return false
+	}
+	for _, r := range id {
+		if !(r == '-' || r == '_' || (r >= '0' && r <= '9') || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')) {
+			return false
+		}
+	}
+	return true
+}
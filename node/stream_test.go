@@ -0,0 +1,275 @@
+package node
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newStreamTestNode(t *testing.T, client StreamClient) *NodeConfig {
+	temp := NodeConfig{
+		BaseFilePath:   t.TempDir(),
+		Storage:        &MemoryStorage{},
+		PublicAddr:     &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1},
+		RequestTimeout: 100 * time.Millisecond,
+		StreamClient:   client,
+	}
+	temp.Node.Oauth.UserName = "stream"
+	temp.Record.OnlineNodes.NodesList = map[string]Node{}
+	n := MustInitServer(temp, "", func(ctx context.Context, remoteAddr string, message *Message) (*Message, error) {
+		return nil, context.Canceled
+	})
+	t.Cleanup(n.Stop)
+	return n
+}
+
+var peerKey, _ = generateKey()
+
+// signedBy signs mssg as the node name holding key, for the peers simulated by tests
+func signedBy(key ed25519.PrivateKey, name string, mssg *Message) *Message {
+	mssg.Header.Node.Oauth.UserName = name
+	mssg.Header.Node.PublicKey = encodePublicKey(key)
+	mssg.Header.Timestamp = time.Now()
+	mssg.Header.Nonce = randomText()
+	mssg.Header.Signature = ""
+	raw, _ := json.Marshal(mssg)
+	mssg.Header.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, raw))
+	return mssg
+}
+
+// a stream call lasts as long as chunks keep coming, a stalled one is canceled after RequestTimeout
+func TestSendStreamTimeout(t *testing.T) {
+	n := newStreamTestNode(t, func(ctx context.Context, remoteAddr string, message *Message, body io.Reader) (*Message, io.ReadCloser, error) {
+		chunk := make([]byte, 1)
+		for i := 0; i < 4; i++ {
+			select {
+			case <-time.After(60 * time.Millisecond):
+			case <-ctx.Done():
+				return nil, nil, ctx.Err()
+			}
+			body.Read(chunk)
+		}
+		<-ctx.Done()
+		return nil, nil, ctx.Err()
+	})
+
+	start := time.Now()
+	_, resBody, err := n.sendStream(context.Background(), "peer", &Message{}, strings.NewReader("stream"))
+	elapsed := time.Since(start)
+	if err != context.Canceled || resBody != nil {
+		t.Fatalf("sendStream returned %v and body %v, want the call canceled", err, resBody)
+	}
+	if elapsed < 240*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("stalled call canceled after %s", elapsed)
+	}
+}
+
+// reading the response body keeps the call alive, closing it ends the call
+func TestSendStreamResponseBody(t *testing.T) {
+	var callCtx context.Context
+	n := newStreamTestNode(t, func(ctx context.Context, remoteAddr string, message *Message, body io.Reader) (*Message, io.ReadCloser, error) {
+		callCtx = ctx
+		pr, pw := io.Pipe()
+		go func() {
+			for i := 0; i < 4; i++ {
+				select {
+				case <-time.After(60 * time.Millisecond):
+				case <-ctx.Done():
+					pw.CloseWithError(ctx.Err())
+					return
+				}
+				pw.Write([]byte("x"))
+			}
+			pw.Close()
+		}()
+		return signedBy(peerKey, "peer", &Message{Body: *messageBodyFormat(CodeResponse, StatusOk, "")}), pr, nil
+	})
+
+	_, resBody, err := n.sendStream(context.Background(), "peer", &Message{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := io.ReadAll(resBody)
+	if err != nil || string(raw) != "xxxx" {
+		t.Fatalf("read %q, %v", raw, err)
+	}
+	if callCtx.Err() != nil {
+		t.Fatal("call canceled before the response body was closed")
+	}
+	resBody.Close()
+	if callCtx.Err() == nil {
+		t.Fatal("call still running after the response body was closed")
+	}
+}
+
+func writeChunk(t *testing.T, n *NodeConfig, chunk ChunkContent, body io.Reader) (ResponseStatus, ChunkContent) {
+	t.Helper()
+	chunkRaw, _ := json.Marshal(&chunk)
+	mssg := &Message{Body: *messageBodyFormat(CodeWriteChunk, "", string(chunkRaw))}
+	mssg.Header.Node.Oauth.UserName = "peer"
+	res := n.HandleCodeWriteChunk(mssg, body)
+	var resChunk ChunkContent
+	json.Unmarshal([]byte(res.Body.Content), &resChunk)
+	return res.Body.Status, resChunk
+}
+
+func chunkSum(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestWriteChunkChecksum(t *testing.T) {
+	n := newStreamTestNode(t, nil)
+	if m := n.ClientCreateFile("upload.txt"); m.Status != StatusOk {
+		t.Fatal(m.Status)
+	}
+
+	status, chunk := writeChunk(t, n, ChunkContent{Name: "upload.txt", Upload: "up1"}, strings.NewReader("abc"))
+	if status != StatusBadFormat {
+		t.Fatalf("chunk without hash answered with %q", status)
+	}
+	status, chunk = writeChunk(t, n, ChunkContent{Name: "upload.txt", Upload: "up1", SHA256: chunkSum("abc")}, strings.NewReader("abc"))
+	if status != StatusOk || chunk.Offset != 3 {
+		t.Fatalf("got %q at %d", status, chunk.Offset)
+	}
+	status, chunk = writeChunk(t, n, ChunkContent{Name: "upload.txt", Upload: "up1", Offset: 3, SHA256: chunkSum("def")}, strings.NewReader("dex"))
+	if status != StatusChecksumMismatch || chunk.Offset != 3 {
+		t.Fatalf("corrupted chunk answered with %q at %d", status, chunk.Offset)
+	}
+	status, _ = writeChunk(t, n, ChunkContent{Name: "upload.txt", Upload: "up1", Offset: 3, Final: true, SHA256: chunkSum("def")}, strings.NewReader("def"))
+	if status != StatusOk {
+		t.Fatal(status)
+	}
+	content, err := n.Storage.Read("upload.txt", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer content.Close()
+	if data, _ := io.ReadAll(content); string(data) != "abcdef" {
+		t.Fatalf("file content %q", data)
+	}
+}
+
+func TestWriteChunkUploadName(t *testing.T) {
+	n := newStreamTestNode(t, nil)
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if m := n.ClientCreateFile(name); m.Status != StatusOk {
+			t.Fatal(m.Status)
+		}
+	}
+	if status, _ := writeChunk(t, n, ChunkContent{Name: "a.txt", Upload: "shared", SHA256: chunkSum("abc")}, strings.NewReader("abc")); status != StatusOk {
+		t.Fatal(status)
+	}
+	// the id of an upload of a.txt doesn't reach it through b.txt
+	status, chunk := writeChunk(t, n, ChunkContent{Name: "b.txt", Upload: "shared"}, nil)
+	if status != StatusOk || chunk.Offset != 0 {
+		t.Fatalf("upload of b.txt got %q at %d", status, chunk.Offset)
+	}
+	if _, chunk = writeChunk(t, n, ChunkContent{Name: "a.txt", Upload: "shared"}, nil); chunk.Offset != 3 {
+		t.Fatalf("upload of a.txt at %d", chunk.Offset)
+	}
+}
+
+func TestPruneUploads(t *testing.T) {
+	n := newStreamTestNode(t, nil)
+	dir := filepath.Join(stateDir(n), uploadsDirName)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	stale, fresh := filepath.Join(dir, "stale"), filepath.Join(dir, "fresh")
+	for _, p := range []string{stale, fresh} {
+		if err := os.WriteFile(p, []byte("x"), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-uploadTTL - time.Minute)
+	os.Chtimes(stale, old, old)
+
+	pruneUploads(n)
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Fatalf("stale upload kept: %v", err)
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Fatalf("fresh upload removed: %v", err)
+	}
+}
+
+// failingReader returns data and then fails, like a connection dropped in the middle of a chunk
+type failingReader struct {
+	data string
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.data == "" {
+		return 0, io.ErrUnexpectedEOF
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestWriteChunkBrokenBody(t *testing.T) {
+	n := newStreamTestNode(t, nil)
+	if m := n.ClientCreateFile("broken.txt"); m.Status != StatusOk {
+		t.Fatal(m.Status)
+	}
+	if status, _ := writeChunk(t, n, ChunkContent{Name: "broken.txt", Upload: "up", SHA256: chunkSum("abc")}, strings.NewReader("abc")); status != StatusOk {
+		t.Fatal(status)
+	}
+	status, chunk := writeChunk(t, n, ChunkContent{Name: "broken.txt", Upload: "up", Offset: 3, SHA256: chunkSum("defgh")}, &failingReader{data: "de"})
+	if status != StatusInternalError || chunk.Offset != 3 {
+		t.Fatalf("broken chunk answered with %q at %d", status, chunk.Offset)
+	}
+	if _, chunk = writeChunk(t, n, ChunkContent{Name: "broken.txt", Upload: "up"}, nil); chunk.Offset != 3 {
+		t.Fatalf("upload resumes at %d, the unchecked bytes were kept", chunk.Offset)
+	}
+}
+
+// slowReader returns a byte at a time, so chunks written at once overlap
+type slowReader struct {
+	data string
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	if r.data == "" {
+		return 0, io.EOF
+	}
+	time.Sleep(time.Millisecond)
+	p[0], r.data = r.data[0], r.data[1:]
+	return 1, nil
+}
+
+func TestWriteChunkConcurrent(t *testing.T) {
+	n := newStreamTestNode(t, nil)
+	if m := n.ClientCreateFile("race.txt"); m.Status != StatusOk {
+		t.Fatal(m.Status)
+	}
+	const writers = 8
+	statuses := make(chan ResponseStatus, writers)
+	for i := 0; i < writers; i++ {
+		go func() {
+			status, _ := writeChunk(t, n, ChunkContent{Name: "race.txt", Upload: "up", SHA256: chunkSum("chunk")}, &slowReader{data: "chunk"})
+			statuses <- status
+		}()
+	}
+	written := 0
+	for i := 0; i < writers; i++ {
+		if <-statuses == StatusOk {
+			written++
+		}
+	}
+	_, chunk := writeChunk(t, n, ChunkContent{Name: "race.txt", Upload: "up"}, nil)
+	if written != 1 || chunk.Offset != 5 {
+		t.Fatalf("%d chunks written at offset 0, upload size %d", written, chunk.Offset)
+	}
+}
@@ -2,7 +2,9 @@ package node
 
 import (
 	"crypto/rand"
+	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"time"
 )
 
@@ -34,6 +36,7 @@ func responseFormat(nd *NodeConfig, mssg *Message, status ResponseStatus, oauth
 	if !oauth {
 		v.Header.Node.Oauth = Oauth{}
 	}
+	nd.signMessage(v)
 	return v
 }
 
@@ -49,3 +52,25 @@ func randomText() string {
 	}
 	return hex.EncodeToString(rd)
 }
+
+var errUnknownEncoding = errors.New("unknown content encoding")
+
+func encodeContent(encoding string, data []byte) (string, error) {
+	switch encoding {
+	case "":
+		return string(data), nil
+	case EncodingBase64:
+		return base64.StdEncoding.EncodeToString(data), nil
+	}
+	return "", errUnknownEncoding
+}
+
+func decodeContent(encoding string, content string) ([]byte, error) {
+	switch encoding {
+	case "":
+		return []byte(content), nil
+	case EncodingBase64:
+		return base64.StdEncoding.DecodeString(content)
+	}
+	return nil, errUnknownEncoding
+}
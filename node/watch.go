@@ -0,0 +1,161 @@
+package node
+
+import (
+	"log"
+	"sort"
+	"time"
+)
+
+// CHANGES MADE DIRECTLY IN THE STORAGE ARE PUBLISHED
+//
+// Every watchInterval the storage(BaseFilePath by default) is listed and compared with the owned files of the record(polling works everywhere).
+// A new file or directory is created(CodeCreateFile, CodeCreateDir), a file whose size or modification time changed
+// is published as written if its SHA-256 changed(CodeUpdateFile), and an owned file missing in the storage is deleted(CodeDeleteFile).
+// An owned directory missing in the storage is deleted(CodeDeleteDir) once nothing is left under it in the record.
+// Changes are checked again under writeMx, so writes of the mesh in progress are not mistaken for local ones.
+
+const watchInterval = 2 * time.Second
+
+// fileStamp tells whether a file may have changed without reading it
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+func nodeWatch(node *NodeConfig) {
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+	// stamps of owned files at the last scan
+	seen := map[string]fileStamp{}
+	for {
+		select {
+		case <-ticker.C:
+			watchBaseDir(node, seen)
+		case <-node.stopNode:
+			return
+		}
+	}
+}
+
+// watchBaseDir publishes the changes made in the storage since the last scan
+func watchBaseDir(node *NodeConfig, seen map[string]fileStamp) {
+	infos, err := node.Storage.List()
+	if err != nil {
+		log.Printf("(watchBaseDir) listing the storage failed: %q\n", err)
+		return
+	}
+	found := map[string]StorageInfo{}
+	foundDirs := map[string]bool{}
+	newDirs := []string{}
+	for _, info := range infos {
+		name := string(info.Name)
+		if !info.IsDir {
+			found[name] = info
+			continue
+		}
+		foundDirs[name] = true
+		if _, ok := node.getFile(name); !ok {
+			// parents are listed first
+			newDirs = append(newDirs, name)
+		}
+	}
+
+	for _, name := range newDirs {
+		if !fileExists(node, FileName(name)) {
+			continue
+		}
+		if m := node.ClientCreateDir(name); m.Status == StatusOk {
+			log.Printf("(watchBaseDir) directory %q was created in the storage\n", name)
+		}
+	}
+	for name, info := range found {
+		f, ok := node.getFile(name)
+		if !ok {
+			if fileExists(node, FileName(name)) {
+				if m := node.ClientCreateFile(name); m.Status == StatusOk {
+					log.Printf("(watchBaseDir) file %q was created in the storage\n", name)
+				}
+			}
+			continue
+		}
+		if f.Owner != node.Node.Oauth.UserName || f.IsDir {
+			continue
+		}
+		stamp := fileStamp{size: info.Size, modTime: info.ModTime}
+		last, ok := seen[name]
+		if !ok {
+			// what the owner published last
+			last = fileStamp{size: f.Size, modTime: f.ModTime}
+		}
+		if stamp.size != last.size || !stamp.modTime.Equal(last.modTime) {
+			watchedFileChanged(node, name)
+		}
+		seen[name] = stamp
+	}
+	for name := range seen {
+		if _, ok := found[name]; !ok {
+			delete(seen, name)
+		}
+	}
+	removedDirs := []string{}
+	for _, f := range ownedFiles(node) {
+		if f.IsDir {
+			if !foundDirs[f.Name] {
+				removedDirs = append(removedDirs, f.Name)
+			}
+		} else if _, ok := found[f.Name]; !ok {
+			watchedFileRemoved(node, f.Name)
+		}
+	}
+	// children before their parent
+	sort.Sort(sort.Reverse(sort.StringSlice(removedDirs)))
+	for _, name := range removedDirs {
+		watchedDirRemoved(node, name)
+	}
+}
+
+func watchedFileChanged(node *NodeConfig, name string) {
+	node.writeMx.Lock()
+	defer node.writeMx.Unlock()
+	f, ok := node.getFile(name)
+	if !ok || f.Owner != node.Node.Oauth.UserName || f.IsDir {
+		return
+	}
+	if fileMetadata(node, f).SHA256 == f.SHA256 {
+		// only touched, or written by the mesh since the last scan
+		return
+	}
+	log.Printf("(watchBaseDir) file %q was modified in the storage\n", name)
+	node.ownedFileWritten(f, node.Node.Oauth.UserName)
+}
+
+func watchedFileRemoved(node *NodeConfig, name string) {
+	node.writeMx.Lock()
+	defer node.writeMx.Unlock()
+	f, ok := node.getFile(name)
+	if !ok || f.Owner != node.Node.Oauth.UserName || f.IsDir || fileExists(node, FileName(name)) {
+		return
+	}
+	log.Printf("(watchBaseDir) file %q was removed from the storage\n", name)
+	updates := updateTimeNow(CodeDeleteFile, node.Node.Oauth.UserName, "")
+	clientMakeCUD(node, f, updates)
+	node.deleteFile(f.Name, updates)
+	deleteVersions(node, f)
+}
+
+// watchedDirRemoved deletes an owned directory removed from the storage, unless files of other nodes are still under it
+func watchedDirRemoved(node *NodeConfig, name string) {
+	node.writeMx.Lock()
+	defer node.writeMx.Unlock()
+	f, ok := node.getFile(name)
+	if !ok || f.Owner != node.Node.Oauth.UserName || !f.IsDir || fileExists(node, FileName(name)) {
+		return
+	}
+	if len(node.dirTree(FileName(name)).Children) > 0 {
+		return
+	}
+	log.Printf("(watchBaseDir) directory %q was removed from the storage\n", name)
+	updates := updateTimeNow(CodeDeleteDir, node.Node.Oauth.UserName, "")
+	clientMakeCUD(node, f, updates)
+	node.deleteFile(f.Name, updates)
+}